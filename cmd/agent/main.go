@@ -104,7 +104,8 @@ func reconcile(cfg cfgAgent) error {
 	defer reconMu.Unlock()
 
 	// Xoá bảng cũ (nếu có) bằng lệnh riêng, bỏ qua lỗi nếu chưa tồn tại
-	_ = runCmdIgnoreErr(cfg.NftBinary, "delete", "table", "ip", "pgw")
+	_ = runCmdIgnoreErr(cfg.NftBinary, "delete", "table", "ip", "pgw") // before IPv6, NAT lived here
+	_ = runCmdIgnoreErr(cfg.NftBinary, "delete", "table", "inet", "pgw")
 	_ = runCmdIgnoreErr(cfg.NftBinary, "delete", "table", "inet", "pgw_filter")
 
 	mvs, err := fetchMappings(cfg.APIBase)
@@ -160,7 +161,7 @@ func fetchMappings(apiBase string) ([]types.MappingView, error) {
 }
 
 type rule struct {
-	Prefix string // "192.168.2.0/24"
+	Prefix string // "192.168.2.0/24" or "fd00::/64"
 	Bits   int
 	Port   int
 }
@@ -171,13 +172,21 @@ func renderRules(cfg cfgAgent, mvs []types.MappingView) string {
 	// Thu thập và dedup theo (prefix|port)
 	seen := map[string]bool{}
 	all := []rule{}
+	blocked := []string{} // over quota: no redirect, all forwarding dropped
 	for _, mv := range mvs {
 		// Only allow traffic for mappings that are explicitly APPLIED
 		s:=strings.ToUpper(mv.State); if s != "APPLIED" && s != "PENDING" { continue }
-		pfx, bits, ok := parseIPv4Prefix(mv.Client.IPCidr)
+		pfx, bits, ok := parsePrefix(mv.Client.IPCidr)
 		if !ok || mv.LocalRedirectPort <= 0 {
 			continue
 		}
+		if mv.Quota != nil && mv.Quota.Exceeded {
+			if !seen[pfx] {
+				seen[pfx] = true
+				blocked = append(blocked, pfx)
+			}
+			continue
+		}
 		key := fmt.Sprintf("%s|%d", pfx, mv.LocalRedirectPort)
 		if !seen[key] {
 			seen[key] = true
@@ -193,7 +202,7 @@ func renderRules(cfg cfgAgent, mvs []types.MappingView) string {
 
 	pruned := []rule{}
 	for port, lst := range group {
-		// Xét từ cha -> con (/0 → /32)
+		// Xét từ cha -> con (/0 → /32, /128)
 		sort.Slice(lst, func(i, j int) bool {
 			if lst[i].Bits != lst[j].Bits {
 				return lst[i].Bits < lst[j].Bits
@@ -230,29 +239,35 @@ func renderRules(cfg cfgAgent, mvs []types.MappingView) string {
 
 	var b strings.Builder
 
-	// NAT
-	fmt.Fprintln(&b, "add table ip pgw")
-	fmt.Fprintln(&b, "add chain ip pgw prerouting { type nat hook prerouting priority dstnat; policy accept; }")
+	// NAT (inet: IPv4 and IPv6 clients alike)
+	fmt.Fprintln(&b, "add table inet pgw")
+	fmt.Fprintln(&b, "add chain inet pgw prerouting { type nat hook prerouting priority dstnat; policy accept; }")
 	for _, r := range pruned {
-		fmt.Fprintf(&b, "add rule ip pgw prerouting iifname \"%s\" ip saddr %s tcp dport {80,443} redirect to :%d\n", cfg.LANIF, r.Prefix, r.Port)
+		fmt.Fprintf(&b, "add rule inet pgw prerouting iifname \"%s\" %s tcp dport {80,443} redirect to :%d\n", cfg.LANIF, saddr(r.Prefix), r.Port)
 	}
 
 	// FILTER
 	fmt.Fprintln(&b, "add table inet pgw_filter")
 	fmt.Fprintln(&b, "add chain inet pgw_filter forward { type filter hook forward priority 0; policy accept; }")
 	fmt.Fprintln(&b, "add rule inet pgw_filter forward ct state established,related accept")
-	// Drop all IPv6 forwarding from LAN->WAN to avoid leaks (no IPv6 redirect)
+	// Drop all other IPv6 forwarding from LAN->WAN: unmapped hosts pick new
+	// privacy addresses and would leak around the proxies. Mapped IPv6
+	// clients are redirected above, which goes through input, not forward.
 	fmt.Fprintf(&b, "add rule inet pgw_filter forward iifname \"%s\" oifname \"%s\" meta nfproto ipv6 drop\n", cfg.LANIF, cfg.WANIF)
+	sort.Strings(blocked)
+	for _, pfx := range blocked {
+		fmt.Fprintf(&b, "add rule inet pgw_filter forward %s drop\n", saddr(pfx))
+	}
 	for _, r := range pruned {
-		fmt.Fprintf(&b, "add rule inet pgw_filter forward ip saddr %s oifname \"%s\" drop\n", r.Prefix, cfg.WANIF)
-		fmt.Fprintf(&b, "add rule inet pgw_filter forward ip saddr %s meta l4proto udp drop\n", r.Prefix)
+		fmt.Fprintf(&b, "add rule inet pgw_filter forward %s oifname \"%s\" drop\n", saddr(r.Prefix), cfg.WANIF)
+		fmt.Fprintf(&b, "add rule inet pgw_filter forward %s meta l4proto udp drop\n", saddr(r.Prefix))
 	}
 	fmt.Fprintln(&b, "add chain inet pgw_filter input { type filter hook input priority 0; policy accept; }")
 	fmt.Fprintln(&b, "add rule inet pgw_filter input ct state established,related accept")
 	for _, r := range pruned {
-		fmt.Fprintf(&b, "add rule inet pgw_filter input iifname \"%s\" ip saddr %s udp dport 53 accept\n", cfg.LANIF, r.Prefix)
-		fmt.Fprintf(&b, "add rule inet pgw_filter input iifname \"%s\" ip saddr %s tcp dport 53 accept\n", cfg.LANIF, r.Prefix)
-		fmt.Fprintf(&b, "add rule inet pgw_filter input iifname \"%s\" ip saddr %s tcp dport %d accept\n", cfg.LANIF, r.Prefix, r.Port)
+		fmt.Fprintf(&b, "add rule inet pgw_filter input iifname \"%s\" %s udp dport 53 accept\n", cfg.LANIF, saddr(r.Prefix))
+		fmt.Fprintf(&b, "add rule inet pgw_filter input iifname \"%s\" %s tcp dport 53 accept\n", cfg.LANIF, saddr(r.Prefix))
+		fmt.Fprintf(&b, "add rule inet pgw_filter input iifname \"%s\" %s tcp dport %d accept\n", cfg.LANIF, saddr(r.Prefix), r.Port)
 	}
 
 	fmt.Fprintf(&b, "add rule inet pgw_filter input iifname \"%s\" tcp dport 15001-15999 drop\n", cfg.LANIF)
@@ -260,15 +275,26 @@ func renderRules(cfg cfgAgent, mvs []types.MappingView) string {
 	return b.String()
 }
 
-func parseIPv4Prefix(cidr string) (string, int, bool) {
+func parsePrefix(cidr string) (string, int, bool) {
 	pfx, err := netip.ParsePrefix(cidr)
-	if err != nil || !pfx.Addr().Is4() {
+	if err != nil || pfx.Addr().Zone() != "" {
 		return "", 0, false
 	}
+	if pfx.Addr().Is4In6() && pfx.Bits() >= 96 {
+		pfx = netip.PrefixFrom(pfx.Addr().Unmap(), pfx.Bits()-96)
+	}
 	pfx = pfx.Masked()
 	return pfx.String(), pfx.Bits(), true
 }
 
+// saddr is the nft source match for prefix, by address family.
+func saddr(prefix string) string {
+	if strings.Contains(prefix, ":") {
+		return "ip6 saddr " + prefix
+	}
+	return "ip saddr " + prefix
+}
+
 func runCmdIgnoreErr(bin string, args ...string) error {
 	cmd := exec.Command(bin, args...)
 	_ = cmd.Run()
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/check"
+	"github.com/Chinsusu/proxy-server-local/pkg/store"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// validateChain checks p.Chain against the existing proxies. Chains are
+// flat: a hop has no chain of its own and a proxy used as a hop gets none.
+func validateChain(p types.Proxy, all []types.Proxy) error {
+	if len(p.Chain) == 0 {
+		return nil
+	}
+	if users := hopUsers(p.ID, all); len(users) > 0 {
+		return fmt.Errorf("proxy is a hop of %s and cannot have a chain itself", users[0])
+	}
+	byID := map[string]types.Proxy{}
+	for _, q := range all {
+		byID[q.ID] = q
+	}
+	seen := map[string]bool{}
+	for _, id := range p.Chain {
+		hop, ok := byID[id]
+		switch {
+		case id == p.ID && p.ID != "":
+			return fmt.Errorf("chain cannot contain the proxy itself")
+		case seen[id]:
+			return fmt.Errorf("duplicate proxy in chain: %s", id)
+		case !ok:
+			return fmt.Errorf("chain proxy not found: %s", id)
+		case len(hop.Chain) > 0:
+			return fmt.Errorf("chain proxy %s has a chain of its own", id)
+		case hop.Type == "ssh":
+			return fmt.Errorf("chain proxy %s: ssh proxies can only end a chain", id)
+		}
+		if err := validateProxyType(hop.Type); err != nil {
+			return fmt.Errorf("chain proxy %s: %w", id, err)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// hopUsers returns the IDs of proxies whose chain goes through id.
+func hopUsers(id string, all []types.Proxy) []string {
+	var out []string
+	for _, p := range all {
+		for _, h := range p.Chain {
+			if h == id {
+				out = append(out, p.ID)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// checkProxy health-checks p end to end, through its chain if it has one.
+func checkProxy(ctx context.Context, st store.Store, p types.Proxy) check.Result {
+	if len(p.Chain) == 0 {
+		return check.CheckProxy(ctx, p)
+	}
+	hops := make([]types.Proxy, 0, len(p.Chain))
+	for _, id := range p.Chain {
+		hop, ok := st.GetProxy(id)
+		if !ok {
+			return check.Result{Status: types.StatusDown, Err: fmt.Errorf("chain proxy not found: %s", id)}
+		}
+		hops = append(hops, hop)
+	}
+	return check.CheckChain(ctx, hops, p)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/httpx"
+)
+
+// fwdControls lists the control addresses of the running forwarders. Each
+// pgw-fwd announces its own in <PGW_FWD_STATUS_DIR>/fwd-<pid>.json (one per
+// port in unit mode); with none found PGW_FWD_CONTROL_ADDR is asked.
+func fwdControls() []string {
+	dir := strings.TrimSpace(os.Getenv("PGW_FWD_STATUS_DIR"))
+	if dir == "" {
+		dir = "/run/pgw"
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "fwd-*.json"))
+	var out []string
+	seen := map[string]bool{}
+	for _, f := range files {
+		var st struct {
+			Control   string    `json:"control"`
+			UpdatedAt time.Time `json:"updated_at"`
+		}
+		b, err := os.ReadFile(f)
+		// a file not refreshed for a while belongs to a process that died
+		if err != nil || json.Unmarshal(b, &st) != nil || st.Control == "" || seen[st.Control] || time.Since(st.UpdatedAt) > 10*time.Second {
+			continue
+		}
+		seen[st.Control] = true
+		out = append(out, st.Control)
+	}
+	if len(out) == 0 {
+		addr := strings.TrimSpace(os.Getenv("PGW_FWD_CONTROL_ADDR"))
+		if addr == "" {
+			addr = "127.0.0.1:9091"
+		}
+		out = append(out, addr)
+	}
+	return out
+}
+
+// fwdControl sends r (method and query string) to path on every forwarder
+// and returns their answers. On failure the error is already written to w
+// and it returns nil.
+func fwdControl(w http.ResponseWriter, r *http.Request, path string) [][]byte {
+	client := &http.Client{Timeout: 5 * time.Second}
+	var bodies [][]byte
+	for _, addr := range fwdControls() {
+		u := "http://" + addr + path
+		if r.URL.RawQuery != "" {
+			u += "?" + r.URL.RawQuery
+		}
+		req, _ := http.NewRequestWithContext(r.Context(), r.Method, u, nil)
+		if tok := os.Getenv("PGW_AGENT_TOKEN"); tok != "" {
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			httpx.JSON(w, 502, map[string]string{"error": "forwarder unreachable: " + err.Error()})
+			return nil
+		}
+		b, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != 200 {
+			httpx.JSON(w, 502, map[string]string{"error": fmt.Sprintf("forwarder %s: %s", addr, resp.Status)})
+			return nil
+		}
+		bodies = append(bodies, b)
+	}
+	return bodies
+}
+
+// fwdAffinity serves /v1/affinity from the sticky tables of all forwarders:
+// GET lists every entry, DELETE clears in each and adds up the counts.
+func fwdAffinity(w http.ResponseWriter, r *http.Request) {
+	bodies := fwdControl(w, r, "/fwd/affinity")
+	if bodies == nil {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		total := 0
+		for _, b := range bodies {
+			var res struct {
+				Cleared int `json:"cleared"`
+			}
+			_ = json.Unmarshal(b, &res)
+			total += res.Cleared
+		}
+		httpx.JSON(w, 200, map[string]int{"cleared": total})
+		return
+	}
+	all := []json.RawMessage{}
+	for _, b := range bodies {
+		var rows []json.RawMessage
+		_ = json.Unmarshal(b, &rows)
+		all = append(all, rows...)
+	}
+	httpx.JSON(w, 200, all)
+}
+
+// fwdConnStats mirrors pgw-fwd's GET /fwd/conns.
+type fwdConnStats struct {
+	MaxPerClient     int              `json:"max_per_client"`
+	MaxPerPort       int              `json:"max_per_port"`
+	QueueMs          int64            `json:"queue_ms"`
+	ActiveByClient   map[string]int   `json:"active_by_client"`
+	ActiveByPort     map[int]int      `json:"active_by_port"`
+	RejectedByClient map[string]int64 `json:"rejected_by_client"`
+	RejectedByPort   map[int]int64    `json:"rejected_by_port"`
+	RejectedTotal    int64            `json:"rejected_total"`
+}
+
+// fwdConns serves /v1/fwd/conns: the counters of all forwarders added up
+// (in unit mode each one only sees its own port).
+func fwdConns(w http.ResponseWriter, r *http.Request) {
+	bodies := fwdControl(w, r, "/fwd/conns")
+	if bodies == nil {
+		return
+	}
+	sum := fwdConnStats{
+		ActiveByClient:   map[string]int{},
+		ActiveByPort:     map[int]int{},
+		RejectedByClient: map[string]int64{},
+		RejectedByPort:   map[int]int64{},
+	}
+	for _, b := range bodies {
+		var s fwdConnStats
+		if json.Unmarshal(b, &s) != nil {
+			continue
+		}
+		// the caps come from the same environment file everywhere
+		sum.MaxPerClient, sum.MaxPerPort, sum.QueueMs = s.MaxPerClient, s.MaxPerPort, s.QueueMs
+		for k, v := range s.ActiveByClient {
+			sum.ActiveByClient[k] += v
+		}
+		for k, v := range s.ActiveByPort {
+			sum.ActiveByPort[k] += v
+		}
+		for k, v := range s.RejectedByClient {
+			sum.RejectedByClient[k] += v
+		}
+		for k, v := range s.RejectedByPort {
+			sum.RejectedByPort[k] += v
+		}
+		sum.RejectedTotal += s.RejectedTotal
+	}
+	httpx.JSON(w, 200, sum)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/httpx"
+	"github.com/Chinsusu/proxy-server-local/pkg/store"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// fwdRoutes serves GET /v1/fwd/routes, the one request pgw-fwd polls: the
+// mappings (pools ordered like /v1/mappings/active), proxies and policies.
+// Unlike /v1/mappings/active it doesn't derive mapping states, which costs
+// a dial and an nft run per mapping. Health telemetry, exit IPs and policy
+// hit counters are left out and the body carries an ETag, so while nothing
+// pgw-fwd uses changes an If-None-Match poll gets a bodiless 304.
+func fwdRoutes(w http.ResponseWriter, r *http.Request, st store.Store) {
+	out := types.FwdRoutes{Mappings: st.ListMappings(), Proxies: st.ListProxies(), Policies: st.ListPolicies()}
+	for i := range out.Mappings {
+		mv := &out.Mappings[i]
+		activeFirst(mv)
+		demoteDown(mv)
+		mv.ExitIP, mv.PrevExitIP = "", ""
+		mv.Proxy = routeProxy(mv.Proxy)
+		for j := range mv.Backups {
+			mv.Backups[j] = routeProxy(mv.Backups[j])
+		}
+	}
+	sort.Slice(out.Proxies, func(i, j int) bool { return out.Proxies[i].ID < out.Proxies[j].ID })
+	for i := range out.Proxies {
+		out.Proxies[i] = routeProxy(out.Proxies[i])
+	}
+	for i := range out.Policies {
+		out.Policies[i].Hits, out.Policies[i].LastHitAt = 0, nil
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		httpx.JSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// routeProxy drops what the health check keeps changing; the status stays
+// since it orders the pool.
+func routeProxy(p types.Proxy) types.Proxy {
+	p.LatencyMs, p.ExitIP, p.LastCheckedAt = nil, nil, nil
+	return p
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/store"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+func TestFwdRoutesETag(t *testing.T) {
+	st := store.NewMemory()
+	p := st.CreateProxy(types.Proxy{Type: "http", Host: "1.2.3.4", Port: 3128, Enabled: true})
+	c := st.CreateClient(types.Client{IPCidr: "192.168.2.3/32", Enabled: true})
+	if _, ok := st.CreateMapping(types.Mapping{ClientID: c.ID, ProxyID: p.ID, LocalRedirectPort: 15001}); !ok {
+		t.Fatal("mapping not created")
+	}
+	st.SetProxyTelemetry(p.ID, types.StatusOK, 120, "5.6.7.8")
+	get := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/fwd/routes", nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		fwdRoutes(w, r, st)
+		return w
+	}
+
+	w := get("")
+	etag := w.Header().Get("ETag")
+	var got types.FwdRoutes
+	if w.Code != 200 || etag == "" || json.Unmarshal(w.Body.Bytes(), &got) != nil {
+		t.Fatalf("first poll: %d %q %s", w.Code, etag, w.Body)
+	}
+	if len(got.Mappings) != 1 || got.Mappings[0].LocalRedirectPort != 15001 || got.Mappings[0].Proxy.LatencyMs != nil {
+		t.Fatalf("got %+v", got)
+	}
+
+	if w := get(etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("unchanged poll: %d %s", w.Code, w.Body)
+	}
+	// a health check that only moves the latency changes nothing pgw-fwd uses
+	st.SetProxyTelemetry(p.ID, types.StatusOK, 95, "5.6.7.9")
+	if w := get(etag); w.Code != http.StatusNotModified {
+		t.Fatalf("after a latency change: %d", w.Code)
+	}
+	// a proxy going down reorders pools
+	st.SetProxyTelemetry(p.ID, types.StatusDown, 0, "")
+	if w := get(etag); w.Code != 200 || w.Header().Get("ETag") == etag {
+		t.Fatalf("after a status change: %d %q", w.Code, w.Header().Get("ETag"))
+	}
+}
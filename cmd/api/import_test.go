@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseColonLine(t *testing.T) {
+	tests := []struct {
+		line, typ, host string
+		port            int
+		user            string
+	}{
+		{"1.2.3.4:8080", "http", "1.2.3.4", 8080, ""},
+		{"1.2.3.4:1080:u:p", "socks5", "1.2.3.4", 1080, "u"},
+		{"proxy.example.com:3128:u:p", "http", "proxy.example.com", 3128, "u"},
+		{"[2001:db8::1]:1080", "socks5", "2001:db8::1", 1080, ""},
+		{"[2001:db8::1]:8080:u:p", "http", "2001:db8::1", 8080, "u"},
+	}
+	for _, tt := range tests {
+		p, err := parseColonLine(tt.line, "")
+		if err != nil {
+			t.Errorf("%s: %v", tt.line, err)
+			continue
+		}
+		user := ""
+		if p.Username != nil {
+			user = *p.Username
+		}
+		if p.Type != tt.typ || p.Host != tt.host || p.Port != tt.port || user != tt.user {
+			t.Errorf("%s: got %s %s %d %q", tt.line, p.Type, p.Host, p.Port, user)
+		}
+	}
+	for _, line := range []string{"2001:db8::1:1080", "[2001:db8::1]", "[2001:db8::1]1080", "[2001:db8::1]:1080:u", "host:0"} {
+		if _, err := parseColonLine(line, ""); err == nil {
+			t.Errorf("%s: accepted", line)
+		}
+	}
+}
+
+func TestCheckPublicHost(t *testing.T) {
+	for _, h := range []string{"127.0.0.1", "::1", "10.1.2.3", "192.168.2.1", "172.16.0.1", "169.254.169.254", "fe80::1", "fd00::5", "0.0.0.0", "::ffff:127.0.0.1"} {
+		if checkPublicHost(h) == nil {
+			t.Errorf("%s: allowed", h)
+		}
+	}
+	for _, h := range []string{"8.8.8.8", "2001:4860:4860::8888", "example.com"} {
+		if err := checkPublicHost(h); err != nil {
+			t.Errorf("%s: %v", h, err)
+		}
+	}
+}
+
+func TestFetchSubscriptionRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("socks5://1.2.3.4:1080\n"))
+	}))
+	defer srv.Close()
+	// by IP literal, and by a name that resolves to loopback
+	for _, u := range []string{srv.URL, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)} {
+		if _, err := fetchSubscription(context.Background(), u); err == nil || !strings.Contains(err.Error(), "not public") {
+			t.Errorf("%s: %v, want refusal", u, err)
+		}
+	}
+}
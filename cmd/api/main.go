@@ -18,6 +18,7 @@ import (
 	"github.com/Chinsusu/proxy-server-local/pkg/config"
 	"github.com/Chinsusu/proxy-server-local/pkg/httpx"
 	"github.com/Chinsusu/proxy-server-local/pkg/logging"
+	"github.com/Chinsusu/proxy-server-local/pkg/shadowsocks"
 	"github.com/Chinsusu/proxy-server-local/pkg/store"
 	"github.com/Chinsusu/proxy-server-local/pkg/types"
 )
@@ -67,6 +68,15 @@ func main() {
 		}
 	}()
 
+	// interval-mode exit IP rotation
+	go func() {
+		t := time.NewTicker(30 * time.Second)
+		defer t.Stop()
+		for range t.C {
+			runRotationTick(st)
+		}
+	}()
+
 	http.HandleFunc("/v1/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
@@ -141,8 +151,41 @@ func main() {
 				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
 				return
 			}
+			if p.Type != "https" {
+				p.TLS = nil
+			} else if _, err := check.ProxyTLSConfig(p.Host, p.TLS); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
+			if p.Type != "ssh" {
+				p.SSH = nil
+			} else if err := validateSSH(p); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
+			if p.Type != "http" && p.Type != "https" {
+				p.PlainHTTP = false
+			}
+			if err := validateAuthScheme(p); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
+			if err := validateProxyProtocol(p); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
+			if p.Type != "shadowsocks" {
+				p.Cipher = ""
+			} else if err := validateShadowsocks(p); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
 			// Check for duplicate proxy
 			existingProxies := st.ListProxies()
+			if err := validateChain(p, existingProxies); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
 			if isProxyDuplicate(p, existingProxies) {
 				httpx.JSON(w, 409, map[string]string{"error": "proxy already exists with same host, port, username, and password"})
 				return
@@ -166,47 +209,36 @@ func main() {
 		}
 
 		path := strings.TrimPrefix(r.URL.Path, "/v1/proxies/")
-		// POST /v1/proxies/{id}/check
-		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/check") {
-			id := strings.TrimSuffix(path, "/check")
-			var target types.Proxy
-			found := false
-			for _, p := range st.ListProxies() {
-				if p.ID == id {
-					target = p
-					found = true
-					break
-				}
-			}
-			if !found {
-				httpx.JSON(w, 404, map[string]string{"error": "not found"})
+		// POST /v1/proxies/import
+		if path == "import" {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(405)
 				return
 			}
-			if target.Type != "http" && target.Type != "socks5" {
-				httpx.JSON(w, 400, map[string]string{"error": "only http and socks5 supported"})
+			if role != "admin" {
+				httpx.JSON(w, 403, map[string]string{"error": "forbidden"})
 				return
 			}
-			ctx, cancel := context.WithTimeout(context.Background(), 12*time.Second)
-			var res check.Result
-			if target.Type == "socks5" {
-				res = check.CheckSOCKS5(ctx, target.Host, target.Port, target.Username, target.Password)
-			} else {
-				res = check.CheckHTTP(ctx, target.Host, target.Port, target.Username, target.Password)
-			}
-			cancel()
-			if res.Err != nil {
-				st.SetProxyTelemetry(target.ID, types.StatusDown, 0, "")
-				httpx.JSON(w, 200, res)
+			importProxies(w, r, st)
+			return
+		}
+		// /v1/proxies/{id}/{action}; only check is open to the agent token
+		if parts := strings.SplitN(path, "/", 2); len(parts) == 2 && parts[0] != "" {
+			if role != "admin" && !(parts[1] == "check" && r.Method == http.MethodPost) {
+				httpx.JSON(w, 403, map[string]string{"error": "forbidden"})
 				return
 			}
-			st.SetProxyTelemetry(target.ID, res.Status, res.LatencyMs, res.ExitIP)
-			httpx.JSON(w, 200, res)
+			proxyAction(w, r, st, parts[0], parts[1])
 			return
 		}
 
 		// DELETE /v1/proxies/{id}
 		if r.Method == http.MethodDelete && path != "" && !strings.Contains(path, "/") {
 			id := path
+			if users := hopUsers(id, st.ListProxies()); len(users) > 0 {
+				httpx.JSON(w, 409, map[string]string{"error": "proxy is a chain hop of " + strings.Join(users, ", ")})
+				return
+			}
 			// collect ports of mappings referencing this proxy (before delete)
 			ports := map[int]struct{}{}
 			for _, mv := range st.ListMappings() {
@@ -231,8 +263,7 @@ func main() {
 						}
 					}
 					if !stillUsed {
-						_ = os.Remove(fmt.Sprintf("/var/lib/pgw/ports/%d", port))
-						_ = exec.Command("sudo", "systemctl", "stop", fmt.Sprintf("pgw-fwd@%d", port)).Run()
+						stopForwarder(port)
 					}
 				}
 				_ = reconcileNow()
@@ -266,13 +297,25 @@ func main() {
 				httpx.JSON(w, 400, map[string]string{"error": "bad json"})
 				return
 			}
-			// enforce /32, normalise IP-only to /32
-			norm, err := normalizeIPv4HostCIDR(c.IPCidr)
+			// enforce /32 (/128), normalise IP-only to /32 (/128)
+			norm, err := normalizeHostCIDR(c.IPCidr)
 			if err != nil {
 				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
 				return
 			}
 			c.IPCidr = norm
+			if err := validateRules(st, c.Rules); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
+			if err := validateRateLimit(c.RateLimit); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
+			if c.MaxConns < -1 {
+				httpx.JSON(w, 400, map[string]string{"error": "max_conns must be >= -1"})
+				return
+			}
 
 			c = st.CreateClient(c)
 			httpx.JSON(w, 201, c)
@@ -294,6 +337,37 @@ func main() {
 			return
 		}
 
+		// /v1/clients/{id}/rules[/{rule}]
+		if parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); len(parts) >= 4 && parts[3] == "rules" && parts[2] != "" {
+			ruleID := ""
+			if len(parts) == 5 {
+				ruleID = parts[4]
+			} else if len(parts) > 5 {
+				w.WriteHeader(404)
+				return
+			}
+			clientRules(w, r, st, parts[2], ruleID)
+			return
+		}
+		// /v1/clients/{id}/quota[/reset]
+		if parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); len(parts) >= 4 && parts[3] == "quota" && parts[2] != "" {
+			if len(parts) > 5 {
+				w.WriteHeader(404)
+				return
+			}
+			quotaAction(w, r, st, "client", parts[2], strings.Join(parts[4:], ""))
+			return
+		}
+		// /v1/clients/{id}/ratelimit
+		if parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); len(parts) == 4 && parts[3] == "ratelimit" && parts[2] != "" {
+			rateLimitAction(w, r, st, parts[2])
+			return
+		}
+		// /v1/clients/{id}/conns
+		if parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); len(parts) == 4 && parts[3] == "conns" && parts[2] != "" {
+			clientConnsAction(w, r, st, parts[2])
+			return
+		}
 		if r.Method != http.MethodDelete {
 			w.WriteHeader(405)
 			return
@@ -335,10 +409,10 @@ func main() {
 					views[i].State = ds
 				}
 			}
-			// sort by client IPv4 ascending
+			// sort by client IP ascending
 			sort.SliceStable(views, func(i, j int) bool {
-				ki := ipv4Key(views[i].Client.IPCidr)
-				kj := ipv4Key(views[j].Client.IPCidr)
+				ki := ipKey(views[i].Client.IPCidr)
+				kj := ipKey(views[j].Client.IPCidr)
 				if ki != kj {
 					return ki < kj
 				}
@@ -360,6 +434,30 @@ func main() {
 					return
 				}
 			}
+			if err := validateBackups(m); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
+			if err := validateRotation(m.Rotation); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
+			if m.StickyTTLSec < 0 {
+				httpx.JSON(w, 400, map[string]string{"error": "sticky_ttl_sec must be >= 0"})
+				return
+			}
+			if m.IdleTimeoutSec < 0 {
+				httpx.JSON(w, 400, map[string]string{"error": "idle_timeout_sec must be >= 0"})
+				return
+			}
+			if m.PrewarmConns < -1 || m.PrewarmConns > maxPrewarmConns {
+				httpx.JSON(w, 400, map[string]string{"error": fmt.Sprintf("prewarm_conns must be -1..%d", maxPrewarmConns)})
+				return
+			}
+			if err := validateRateLimit(m.RateLimit); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
 			if m.Protocol == "" {
 				m.Protocol = "http"
 			}
@@ -376,7 +474,7 @@ func main() {
 			}
 
 			// Health-check upstream before applying
-			if mv.Proxy.Type != "http" {
+			if validateProxyType(mv.Proxy.Type) != nil {
 				_ = st.UpdateMappingState(mv.ID, "FAILED", mv.LocalRedirectPort)
 				mv.State = "FAILED"
 				logging.Info.Printf("[DEBUG] Sending JSON response for mapping %s", mv.ID)
@@ -384,12 +482,7 @@ func main() {
 				return
 			}
 			ctx, cancel := context.WithTimeout(context.Background(), 12*time.Second)
-			var res check.Result
-			if mv.Proxy.Type == "socks5" {
-				res = check.CheckSOCKS5(ctx, mv.Proxy.Host, mv.Proxy.Port, mv.Proxy.Username, mv.Proxy.Password)
-			} else {
-				res = check.CheckHTTP(ctx, mv.Proxy.Host, mv.Proxy.Port, mv.Proxy.Username, mv.Proxy.Password)
-			}
+			res := checkProxy(ctx, st, mv.Proxy)
 			cancel()
 			if res.Err != nil {
 				st.SetProxyTelemetry(mv.Proxy.ID, types.StatusDown, 0, "")
@@ -403,10 +496,7 @@ func main() {
 
 			// First-use: ensure flag + start forwarder (best-effort)
 			if mv.LocalRedirectPort > 0 {
-				_ = os.MkdirAll("/var/lib/pgw/ports", 0o755)
-				_ = os.WriteFile(fmt.Sprintf("/var/lib/pgw/ports/%d", mv.LocalRedirectPort), []byte(""), 0o644)
-				// Restart regardless of preUsed to ensure the forwarder switches to the new upstream mapping.
-				_ = exec.Command("sudo", "systemctl", "restart", fmt.Sprintf("pgw-fwd@%d", mv.LocalRedirectPort)).Run()
+				startForwarder(mv.LocalRedirectPort)
 			}
 
 			// Apply: reconcile then mark APPLIED
@@ -451,10 +541,10 @@ func main() {
 			}
 			if ds := deriveMappingState(views[i]); ds != "" {
 				views[i].State = ds
-				// sort by client IPv4 ascending
+				// sort by client IP ascending
 				sort.SliceStable(views, func(i, j int) bool {
-					ki := ipv4Key(views[i].Client.IPCidr)
-					kj := ipv4Key(views[j].Client.IPCidr)
+					ki := ipKey(views[i].Client.IPCidr)
+					kj := ipKey(views[j].Client.IPCidr)
 					if ki != kj {
 						return ki < kj
 					}
@@ -462,6 +552,10 @@ func main() {
 				})
 			}
 		}
+		for i := range views {
+			activeFirst(&views[i])
+			demoteDown(&views[i])
+		}
 		httpx.JSON(w, 200, views)
 	})
 
@@ -514,7 +608,9 @@ func main() {
 			httpx.JSON(w, 401, map[string]string{"error": "unauthorized"})
 			return
 		}
-		if r.Method != http.MethodGet && role != "admin" {
+		// pgw-fwd (agent token) may trigger connection-count rotation
+		agentRotate := role == "agent" && r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/rotate")
+		if r.Method != http.MethodGet && role != "admin" && !agentRotate {
 			httpx.JSON(w, 403, map[string]string{"error": "forbidden"})
 			return
 		}
@@ -523,11 +619,16 @@ func main() {
 		if r.URL.Path == "/v1/mappings" {
 			return
 		}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		// /v1/mappings/{id}/{action}
+		if len(parts) == 4 && parts[0] == "v1" && parts[1] == "mappings" && parts[2] != "" {
+			mappingAction(w, r, st, parts[2], parts[3])
+			return
+		}
 		if r.Method != http.MethodDelete {
 			w.WriteHeader(405)
 			return
 		}
-		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
 		if len(parts) != 3 || parts[0] != "v1" || parts[1] != "mappings" {
 			w.WriteHeader(404)
 			return
@@ -564,14 +665,112 @@ func main() {
 					}
 				}
 				if !stillUsed {
-					_ = os.Remove(fmt.Sprintf("/var/lib/pgw/ports/%d", port))
-					_ = exec.Command("sudo", "systemctl", "stop", fmt.Sprintf("pgw-fwd@%d", port)).Run()
+					stopForwarder(port)
 				}
 				_ = reconcileNow()
 			}(port)
 		}
 	})
 
+	// ---- Traffic accounting (reported by pgw-fwd) ----
+	http.HandleFunc("/v1/traffic", func(w http.ResponseWriter, r *http.Request) {
+		role, ok := authorizeRequest(r, cfg.JWTSecret)
+		if !ok {
+			httpx.JSON(w, 401, map[string]string{"error": "unauthorized"})
+			return
+		}
+		if r.Method != http.MethodGet && role != "admin" && role != "agent" {
+			httpx.JSON(w, 403, map[string]string{"error": "forbidden"})
+			return
+		}
+		traffic(w, r, st)
+	})
+	http.HandleFunc("/v1/traffic/connections", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorizeRequest(r, cfg.JWTSecret); !ok {
+			httpx.JSON(w, 401, map[string]string{"error": "unauthorized"})
+			return
+		}
+		recentConns(w, r, st)
+	})
+
+	// ---- Domain policies (global / per-client deny & allow lists) ----
+	http.HandleFunc("/v1/policies", func(w http.ResponseWriter, r *http.Request) {
+		role, ok := authorizeRequest(r, cfg.JWTSecret)
+		if !ok {
+			httpx.JSON(w, 401, map[string]string{"error": "unauthorized"})
+			return
+		}
+		if r.Method != http.MethodGet && role != "admin" {
+			httpx.JSON(w, 403, map[string]string{"error": "forbidden"})
+			return
+		}
+		policies(w, r, st)
+	})
+	http.HandleFunc("/v1/policies/", func(w http.ResponseWriter, r *http.Request) {
+		role, ok := authorizeRequest(r, cfg.JWTSecret)
+		if !ok {
+			httpx.JSON(w, 401, map[string]string{"error": "unauthorized"})
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/v1/policies/")
+		// pgw-fwd (agent token) reports hit counters
+		if r.Method != http.MethodGet && role != "admin" && !(role == "agent" && id == "hits") {
+			httpx.JSON(w, 403, map[string]string{"error": "forbidden"})
+			return
+		}
+		policyItem(w, r, st, id)
+	})
+
+	// ---- Forwarder host affinity (sticky sessions) ----
+	// GET /v1/affinity, DELETE /v1/affinity?client=<ip>&host=<name>
+	http.HandleFunc("/v1/affinity", func(w http.ResponseWriter, r *http.Request) {
+		role, ok := authorizeRequest(r, cfg.JWTSecret)
+		if !ok {
+			httpx.JSON(w, 401, map[string]string{"error": "unauthorized"})
+			return
+		}
+		if r.Method != http.MethodGet && role != "admin" {
+			httpx.JSON(w, 403, map[string]string{"error": "forbidden"})
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			w.WriteHeader(405)
+			return
+		}
+		fwdAffinity(w, r)
+	})
+
+	// GET /v1/fwd/routes: what pgw-fwd builds its routes from (admin, agent)
+	http.HandleFunc("/v1/fwd/routes", func(w http.ResponseWriter, r *http.Request) {
+		role, ok := authorizeRequest(r, cfg.JWTSecret)
+		if !ok {
+			httpx.JSON(w, 401, map[string]string{"error": "unauthorized"})
+			return
+		}
+		if role != "admin" && role != "agent" {
+			httpx.JSON(w, 403, map[string]string{"error": "forbidden"})
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(405)
+			return
+		}
+		fwdRoutes(w, r, st)
+	})
+
+	// GET /v1/fwd/conns: live connection counts and limit rejections
+	http.HandleFunc("/v1/fwd/conns", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authorizeRequest(r, cfg.JWTSecret); !ok {
+			httpx.JSON(w, 401, map[string]string{"error": "unauthorized"})
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(405)
+			return
+		}
+		fwdConns(w, r)
+	})
+
 	logging.Info.Printf("pgw-api listening on %s\n", cfg.Addr)
 	if err := http.ListenAndServe(cfg.Addr, nil); err != nil {
 		logging.Error.Println(err)
@@ -593,18 +792,35 @@ func reconcileNow() error {
 	return nil
 }
 
+// startForwarder ensures the port flag file and pgw-fwd@<port> unit exist.
+// Start only: a running forwarder hot-reloads its upstream, so open sessions
+// survive re-mapping. In multi-port mode pgw-fwd opens the port by itself.
+func startForwarder(port int) {
+	if config.LoadFwd().Mode == "multi" {
+		return
+	}
+	_ = os.MkdirAll("/var/lib/pgw/ports", 0o755)
+	_ = os.WriteFile(fmt.Sprintf("/var/lib/pgw/ports/%d", port), []byte(""), 0o644)
+	_ = exec.Command("sudo", "systemctl", "start", fmt.Sprintf("pgw-fwd@%d", port)).Run()
+}
+
+// stopForwarder removes the port flag file and stops pgw-fwd@<port>.
+// In multi-port mode pgw-fwd closes the listener once the mapping is gone.
+func stopForwarder(port int) {
+	if config.LoadFwd().Mode == "multi" {
+		return
+	}
+	_ = os.Remove(fmt.Sprintf("/var/lib/pgw/ports/%d", port))
+	_ = exec.Command("sudo", "systemctl", "stop", fmt.Sprintf("pgw-fwd@%d", port)).Run()
+}
+
 func runHealthTick(st store.Store) {
 	for _, p := range st.ListProxies() {
-		if p.Type != "http" && p.Type != "socks5" {
+		if validateProxyType(p.Type) != nil {
 			continue
 		}
 		ctx, cancel := context.WithTimeout(context.Background(), 12*time.Second)
-		var res check.Result
-		if p.Type == "socks5" {
-			res = check.CheckSOCKS5(ctx, p.Host, p.Port, p.Username, p.Password)
-		} else {
-			res = check.CheckHTTP(ctx, p.Host, p.Port, p.Username, p.Password)
-		}
+		res := checkProxy(ctx, st, p)
 		cancel()
 		if res.Err != nil {
 			st.SetProxyTelemetry(p.ID, types.StatusDown, 0, "")
@@ -614,6 +830,31 @@ func runHealthTick(st store.Store) {
 	}
 }
 
+// demoteDown reorders a mapping's pool so members the health tick marked DOWN
+// are tried last by the forwarder; relative order is otherwise kept.
+func demoteDown(mv *types.MappingView) {
+	pool := mv.Pool()
+	if len(pool) < 2 {
+		return
+	}
+	sort.SliceStable(pool, func(i, j int) bool {
+		return pool[i].Status != types.StatusDown && pool[j].Status == types.StatusDown
+	})
+	mv.Proxy, mv.Backups = pool[0], pool[1:]
+}
+
+// validateBackups rejects backup lists that repeat the primary or themselves.
+func validateBackups(m types.Mapping) error {
+	seen := map[string]bool{m.ProxyID: true}
+	for _, id := range m.BackupProxyIDs {
+		if seen[id] {
+			return fmt.Errorf("duplicate proxy in backup_proxy_ids: %s", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
 // deriveMappingState inspects system state to infer mapping status.
 // Returns "APPLIED" or "" (keep stored state).
 func deriveMappingState(mv types.MappingView) string {
@@ -628,14 +869,14 @@ func deriveMappingState(mv types.MappingView) string {
 	}
 	// nft rule check: best effort
 	nftOK := false
-	if out, err := exec.Command("nft", "list", "table", "ip", "pgw").Output(); err == nil {
+	if out, err := exec.Command("nft", "list", "table", "inet", "pgw").Output(); err == nil {
 		ip := mv.Client.IPCidr
 		if i := strings.Index(ip, "/"); i >= 0 {
 			ip = ip[:i]
 		}
 		to := fmt.Sprintf("redirect to :%d", mv.LocalRedirectPort)
 		for _, line := range strings.Split(string(out), "\n") {
-			if strings.Contains(line, "ip saddr "+ip) && strings.Contains(line, to) {
+			if (strings.Contains(line, "ip saddr "+ip) || strings.Contains(line, "ip6 saddr "+ip)) && strings.Contains(line, to) {
 				nftOK = true
 				break
 			}
@@ -695,21 +936,21 @@ func choosePortForClient(st store.Store, clientID string, requested int) (int, e
 	return 0, fmt.Errorf("no free port available in range %d-%d", base, max)
 }
 
-// ipv4Key converts CIDR or IPv4 string to a sortable uint32 key (invalid → MaxUint32)
-func ipv4Key(cidr string) uint32 {
+// ipKey converts a CIDR or IP string to a key that sorts with <: IPv4
+// addresses first, then IPv6, invalid last.
+func ipKey(cidr string) string {
 	ip := cidr
 	if i := strings.Index(ip, "/"); i >= 0 {
 		ip = ip[:i]
 	}
 	p := net.ParseIP(ip)
-	if p == nil {
-		return ^uint32(0)
-	}
-	v4 := p.To4()
-	if v4 == nil {
-		return ^uint32(0)
+	switch {
+	case p == nil:
+		return "\x02"
+	case p.To4() != nil:
+		return "\x00" + string(p.To4())
 	}
-	return uint32(v4[0])<<24 | uint32(v4[1])<<16 | uint32(v4[2])<<8 | uint32(v4[3])
+	return "\x01" + string(p.To16())
 }
 
 // authorizeRequest extracts JWT from Authorization Bearer or pgw_jwt cookie, verifies and returns role.
@@ -773,11 +1014,34 @@ func isProxyDuplicate(new types.Proxy, existing []types.Proxy) bool {
 // validateProxyType validates proxy type field
 func validateProxyType(proxyType string) error {
 	switch proxyType {
-	case "http", "socks5":
+	case "http", "https", "socks5", "socks4", "ssh", "shadowsocks":
 		return nil
 	case "":
 		return fmt.Errorf("proxy type is required")
 	default:
-		return fmt.Errorf("unsupported proxy type: %s (supported: http, socks5)", proxyType)
+		return fmt.Errorf("unsupported proxy type: %s (supported: http, https, socks5, socks4, ssh, shadowsocks)", proxyType)
+	}
+}
+
+// validateSSH checks that an "ssh" proxy has usable credentials and host key.
+func validateSSH(p types.Proxy) error {
+	user, pass := "", ""
+	if p.Username != nil {
+		user = *p.Username
+	}
+	if p.Password != nil {
+		pass = *p.Password
+	}
+	_, err := check.SSHClientConfig(user, pass, p.SSH)
+	return err
+}
+
+// validateShadowsocks checks the cipher and password of a "shadowsocks" proxy.
+func validateShadowsocks(p types.Proxy) error {
+	pass := ""
+	if p.Password != nil {
+		pass = *p.Password
 	}
+	_, err := shadowsocks.New(p.Cipher, pass)
+	return err
 }
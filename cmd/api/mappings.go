@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/httpx"
+	"github.com/Chinsusu/proxy-server-local/pkg/logging"
+	"github.com/Chinsusu/proxy-server-local/pkg/store"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// mappingAction serves /v1/mappings/{id}/{action}:
+//
+//	POST   rotate   → move to the next proxy of the pool (admin or agent)
+//	GET    exits    → exit IP history
+//	PUT    rotation → set rotation policy; DELETE clears it
+//	PUT    sticky   → set host affinity TTL {"ttl_sec":N}; 0 disables
+//	PUT    ratelimit → override the client's rate limit; DELETE clears it
+//	PUT    idle     → set idle timeout {"idle_timeout_sec":N}; 0 = forwarder default
+//	PUT    connect  → {"connect_by_host":bool}: CONNECT by SNI/Host name instead of IP
+//	PUT    prewarm  → {"prewarm_conns":N}: ready upstream sockets; 0 = default, -1 = off
+func mappingAction(w http.ResponseWriter, r *http.Request, st store.Store, id, action string) {
+	m, ok := st.GetMapping(id)
+	if !ok {
+		httpx.JSON(w, 404, map[string]string{"error": "not found"})
+		return
+	}
+	switch {
+	case action == "rotate" && r.Method == http.MethodPost:
+		mv, ok := st.RotateMapping(id)
+		if !ok {
+			httpx.JSON(w, 404, map[string]string{"error": "not found"})
+			return
+		}
+		was := m.ActiveProxyID
+		if was == "" {
+			was = m.ProxyID
+		}
+		if mv.ActiveProxyID == was {
+			httpx.JSON(w, 409, map[string]string{"error": "no usable proxy to rotate to"})
+			return
+		}
+		logging.Info.Printf("mapping %s rotated %s → %s exit_ip=%s", id, was, mv.ActiveProxyID, mv.ExitIP)
+		httpx.JSON(w, 200, mv)
+
+	case action == "exits" && r.Method == http.MethodGet:
+		out := m.ExitHistory
+		if out == nil {
+			out = []types.ExitRecord{}
+		}
+		httpx.JSON(w, 200, out)
+
+	case action == "rotation" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		if r.Method == http.MethodDelete {
+			m.Rotation = nil
+		} else {
+			var rot types.Rotation
+			if err := json.NewDecoder(r.Body).Decode(&rot); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+				return
+			}
+			if err := validateRotation(&rot); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
+			now := time.Now()
+			m.Rotation = &rot
+			m.RotatedAt = &now
+		}
+		mv, ok := st.UpdateMapping(m)
+		if !ok {
+			httpx.JSON(w, 404, map[string]string{"error": "not found"})
+			return
+		}
+		httpx.JSON(w, 200, mv)
+
+	case action == "sticky" && r.Method == http.MethodPut:
+		var req struct {
+			TTLSec int `json:"ttl_sec"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		if req.TTLSec < 0 {
+			httpx.JSON(w, 400, map[string]string{"error": "ttl_sec must be >= 0"})
+			return
+		}
+		m.StickyTTLSec = req.TTLSec
+		mv, ok := st.UpdateMapping(m)
+		if !ok {
+			httpx.JSON(w, 404, map[string]string{"error": "not found"})
+			return
+		}
+		httpx.JSON(w, 200, mv)
+
+	case action == "idle" && r.Method == http.MethodPut:
+		var req struct {
+			IdleTimeoutSec int `json:"idle_timeout_sec"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		if req.IdleTimeoutSec < 0 {
+			httpx.JSON(w, 400, map[string]string{"error": "idle_timeout_sec must be >= 0"})
+			return
+		}
+		m.IdleTimeoutSec = req.IdleTimeoutSec
+		mv, ok := st.UpdateMapping(m)
+		if !ok {
+			httpx.JSON(w, 404, map[string]string{"error": "not found"})
+			return
+		}
+		httpx.JSON(w, 200, mv)
+
+	case action == "connect" && r.Method == http.MethodPut:
+		var req struct {
+			ConnectByHost bool `json:"connect_by_host"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		m.ConnectByHost = req.ConnectByHost
+		mv, ok := st.UpdateMapping(m)
+		if !ok {
+			httpx.JSON(w, 404, map[string]string{"error": "not found"})
+			return
+		}
+		httpx.JSON(w, 200, mv)
+
+	case action == "prewarm" && r.Method == http.MethodPut:
+		var req struct {
+			PrewarmConns int `json:"prewarm_conns"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		if req.PrewarmConns < -1 || req.PrewarmConns > maxPrewarmConns {
+			httpx.JSON(w, 400, map[string]string{"error": fmt.Sprintf("prewarm_conns must be -1..%d", maxPrewarmConns)})
+			return
+		}
+		m.PrewarmConns = req.PrewarmConns
+		mv, ok := st.UpdateMapping(m)
+		if !ok {
+			httpx.JSON(w, 404, map[string]string{"error": "not found"})
+			return
+		}
+		httpx.JSON(w, 200, mv)
+
+	case action == "ratelimit":
+		l, ok := readRateLimit(w, r)
+		if !ok {
+			return
+		}
+		m.RateLimit = l
+		mv, ok := st.UpdateMapping(m)
+		if !ok {
+			httpx.JSON(w, 404, map[string]string{"error": "not found"})
+			return
+		}
+		httpx.JSON(w, 200, mv)
+
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// maxPrewarmConns caps prewarm_conns; every ready socket is a connection
+// held open on the provider.
+const maxPrewarmConns = 32
+
+// validateRotation checks a rotation policy; nil means "no rotation".
+func validateRotation(rot *types.Rotation) error {
+	if rot == nil {
+		return nil
+	}
+	switch rot.Mode {
+	case "interval":
+		if rot.EveryMinutes <= 0 {
+			return fmt.Errorf("rotation.every_minutes must be > 0")
+		}
+	case "connections":
+		if rot.EveryConns <= 0 {
+			return fmt.Errorf("rotation.every_conns must be > 0")
+		}
+	case "manual":
+	default:
+		return fmt.Errorf("unsupported rotation mode: %s (supported: interval, connections, manual)", rot.Mode)
+	}
+	return nil
+}
+
+// runRotationTick rotates every interval-mode mapping whose period elapsed.
+// Connection-count rotation is driven by pgw-fwd calling POST .../rotate.
+func runRotationTick(st store.Store) {
+	now := time.Now()
+	for _, mv := range st.ListMappings() {
+		rot := mv.Rotation
+		if rot == nil || rot.Mode != "interval" || rot.EveryMinutes <= 0 || len(mv.Backups) == 0 {
+			continue
+		}
+		if mv.RotatedAt == nil {
+			// first sighting: start the clock instead of rotating right away
+			if m, ok := st.GetMapping(mv.ID); ok {
+				m.RotatedAt = &now
+				st.UpdateMapping(m)
+			}
+			continue
+		}
+		if now.Sub(*mv.RotatedAt) < time.Duration(rot.EveryMinutes)*time.Minute {
+			continue
+		}
+		if after, ok := st.RotateMapping(mv.ID); ok && after.ActiveProxyID != mv.ActiveProxyID {
+			logging.Info.Printf("mapping %s rotated %s → %s exit_ip=%s (every %dm)", mv.ID, mv.ActiveProxyID, after.ActiveProxyID, after.ExitIP, rot.EveryMinutes)
+		}
+	}
+}
+
+// activeFirst reorders a mapping's pool so the member picked by rotation is
+// tried first; the rest follow in pool order as failover.
+func activeFirst(mv *types.MappingView) {
+	pool := mv.Pool()
+	for i, p := range pool {
+		if i > 0 && p.ID == mv.ActiveProxyID {
+			pool = append(append([]types.Proxy{p}, pool[i+1:]...), pool[:i]...)
+			mv.Proxy, mv.Backups = pool[0], pool[1:]
+			return
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/hostmatch"
+	"github.com/Chinsusu/proxy-server-local/pkg/httpx"
+	"github.com/Chinsusu/proxy-server-local/pkg/store"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// policies serves /v1/policies:
+//
+//	GET  ?client_id=<id>|global → []DomainPolicy with hit counters
+//	POST DomainPolicy           → 201 DomainPolicy
+func policies(w http.ResponseWriter, r *http.Request, st store.Store) {
+	switch r.Method {
+	case http.MethodGet:
+		out := []types.DomainPolicy{}
+		q := r.URL.Query()
+		for _, p := range st.ListPolicies() {
+			if cid := q.Get("client_id"); cid != "" {
+				if cid == "global" && p.ClientID != "" || cid != "global" && p.ClientID != cid {
+					continue
+				}
+			}
+			out = append(out, p)
+		}
+		httpx.JSON(w, 200, out)
+	case http.MethodPost:
+		var p types.DomainPolicy
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		if err := validatePolicy(st, p); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+		p.ID = ""
+		httpx.JSON(w, 201, st.CreatePolicy(p))
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// policyItem serves DELETE /v1/policies/{id} and POST /v1/policies/hits
+// (pgw-fwd reporting {"<policy id>": n}).
+func policyItem(w http.ResponseWriter, r *http.Request, st store.Store, id string) {
+	switch {
+	case id == "hits" && r.Method == http.MethodPost:
+		var hits map[string]int64
+		if err := json.NewDecoder(r.Body).Decode(&hits); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		st.AddPolicyHits(hits)
+		w.WriteHeader(204)
+	case r.Method == http.MethodDelete && id != "":
+		if !st.DeletePolicy(id) {
+			httpx.JSON(w, 404, map[string]string{"error": "not found"})
+			return
+		}
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func validatePolicy(st store.Store, p types.DomainPolicy) error {
+	if p.List != "deny" && p.List != "allow" {
+		return fmt.Errorf("unsupported list: %s (supported: deny, allow)", p.List)
+	}
+	if _, err := hostmatch.Compile(p.Match, p.Pattern); err != nil {
+		return err
+	}
+	if p.ClientID == "" {
+		return nil
+	}
+	for _, c := range st.ListClients() {
+		if c.ID == p.ClientID {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown client_id %q", p.ClientID)
+}
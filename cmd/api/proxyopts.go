@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/httpx"
+	"github.com/Chinsusu/proxy-server-local/pkg/store"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// proxyAction serves /v1/proxies/{id}/{action} (admin):
+//
+//	PUT    quota          → byte quotas; DELETE removes them
+//	POST   quota/reset    → zero the usage counters
+//	PUT    ratelimit      → proxy-wide rate limit; DELETE clears it
+//	PUT    chain          → {"chain":["<proxy id>",...]}: hops in front; DELETE clears them
+//	PUT    plain_http     → {"plain_http":bool}: absolute-URI plain HTTP (http/https only)
+//	PUT    auth_scheme    → {"auth_scheme":""|"basic"|"digest"} (http/https only)
+//	PUT    proxy_protocol → {"proxy_protocol":0|1|2}
+//	POST   check          → health-check now and record telemetry (admin or agent)
+//
+// An unknown action is 404, a known one with the wrong method 405.
+func proxyAction(w http.ResponseWriter, r *http.Request, st store.Store, id, action string) {
+	p, ok := st.GetProxy(id)
+	if !ok {
+		httpx.JSON(w, 404, map[string]string{"error": "not found"})
+		return
+	}
+	switch action {
+	case "quota", "quota/reset":
+		quotaAction(w, r, st, "proxy", p.ID, strings.TrimPrefix(strings.TrimPrefix(action, "quota"), "/"))
+
+	case "ratelimit":
+		l, ok := readRateLimit(w, r)
+		if !ok {
+			return
+		}
+		p.RateLimit = l
+		saveProxy(w, st, p)
+
+	case "chain":
+		var req struct {
+			Chain []string `json:"chain"`
+		}
+		switch r.Method {
+		case http.MethodDelete:
+		case http.MethodPut:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+				return
+			}
+		default:
+			w.WriteHeader(405)
+			return
+		}
+		p.Chain = req.Chain
+		if err := validateChain(p, st.ListProxies()); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+		saveProxy(w, st, p)
+
+	case "plain_http":
+		if r.Method != http.MethodPut {
+			w.WriteHeader(405)
+			return
+		}
+		var req struct {
+			PlainHTTP bool `json:"plain_http"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		if req.PlainHTTP && p.Type != "http" && p.Type != "https" {
+			httpx.JSON(w, 400, map[string]string{"error": "plain_http is only for http and https proxies"})
+			return
+		}
+		p.PlainHTTP = req.PlainHTTP
+		if err := validateAuthScheme(p); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+		saveProxy(w, st, p)
+
+	case "auth_scheme":
+		if r.Method != http.MethodPut {
+			w.WriteHeader(405)
+			return
+		}
+		var req struct {
+			AuthScheme string `json:"auth_scheme"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		p.AuthScheme = req.AuthScheme
+		if err := validateAuthScheme(p); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+		saveProxy(w, st, p)
+
+	case "proxy_protocol":
+		if r.Method != http.MethodPut {
+			w.WriteHeader(405)
+			return
+		}
+		var req struct {
+			ProxyProtocol int `json:"proxy_protocol"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		p.ProxyProtocol = req.ProxyProtocol
+		if err := validateProxyProtocol(p); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+		saveProxy(w, st, p)
+
+	case "check":
+		if r.Method != http.MethodPost {
+			w.WriteHeader(405)
+			return
+		}
+		if err := validateProxyType(p.Type); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 12*time.Second)
+		res := checkProxy(ctx, st, p)
+		cancel()
+		if res.Err != nil {
+			st.SetProxyTelemetry(p.ID, types.StatusDown, 0, "")
+		} else {
+			st.SetProxyTelemetry(p.ID, res.Status, res.LatencyMs, res.ExitIP)
+		}
+		httpx.JSON(w, 200, res)
+
+	default:
+		httpx.JSON(w, 404, map[string]string{"error": "not found"})
+	}
+}
+
+// saveProxy stores p and answers with the result, 404 if the proxy was
+// deleted meanwhile.
+func saveProxy(w http.ResponseWriter, st store.Store, p types.Proxy) {
+	p, ok := st.UpdateProxy(p)
+	if !ok {
+		httpx.JSON(w, 404, map[string]string{"error": "not found"})
+		return
+	}
+	httpx.JSON(w, 200, p)
+}
+
+// validateProxyProtocol checks proxy_protocol: 0 (off), 1 or 2, and not on
+// ssh proxies, whose one session carries every client.
+func validateProxyProtocol(p types.Proxy) error {
+	switch {
+	case p.ProxyProtocol < 0 || p.ProxyProtocol > 2:
+		return fmt.Errorf("proxy_protocol must be 0, 1 or 2")
+	case p.ProxyProtocol != 0 && p.Type == "ssh":
+		return fmt.Errorf("proxy_protocol is not supported for ssh proxies")
+	}
+	return nil
+}
+
+// validateAuthScheme checks auth_scheme. plain_http puts the credentials
+// in every request as Basic, so with credentials it needs "basic": a proxy
+// that wants Digest would refuse each request, and one that was never asked
+// shouldn't get the password in clear.
+func validateAuthScheme(p types.Proxy) error {
+	creds := (p.Username != nil && *p.Username != "") || (p.Password != nil && *p.Password != "")
+	switch {
+	case p.AuthScheme != "" && p.AuthScheme != "basic" && p.AuthScheme != "digest":
+		return fmt.Errorf("auth_scheme must be empty, basic or digest")
+	case p.AuthScheme != "" && p.Type != "http" && p.Type != "https":
+		return fmt.Errorf("auth_scheme is only for http and https proxies")
+	case p.PlainHTTP && creds && p.AuthScheme != "basic":
+		return fmt.Errorf("plain_http sends the credentials as Basic: set auth_scheme to basic")
+	}
+	return nil
+}
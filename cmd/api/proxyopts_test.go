@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+func TestValidateAuthScheme(t *testing.T) {
+	user, empty := "u", ""
+	tests := []struct {
+		name string
+		p    types.Proxy
+		ok   bool
+	}{
+		{"auto", types.Proxy{Type: "http", Username: &user, Password: &user}, true},
+		{"digest", types.Proxy{Type: "https", Username: &user, Password: &user, AuthScheme: "digest"}, true},
+		{"unknown scheme", types.Proxy{Type: "http", AuthScheme: "ntlm"}, false},
+		{"not http", types.Proxy{Type: "socks5", AuthScheme: "basic"}, false},
+		{"plain_http without credentials", types.Proxy{Type: "http", PlainHTTP: true}, true},
+		{"plain_http with empty credentials", types.Proxy{Type: "http", PlainHTTP: true, Username: &empty, Password: &empty}, true},
+		{"plain_http basic", types.Proxy{Type: "http", PlainHTTP: true, Username: &user, Password: &user, AuthScheme: "basic"}, true},
+		{"plain_http auto", types.Proxy{Type: "http", PlainHTTP: true, Username: &user, Password: &user}, false},
+		{"plain_http digest", types.Proxy{Type: "http", PlainHTTP: true, Username: &user, Password: &user, AuthScheme: "digest"}, false},
+	}
+	for _, tt := range tests {
+		if err := validateAuthScheme(tt.p); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/httpx"
+	"github.com/Chinsusu/proxy-server-local/pkg/store"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// quotaAction serves /v1/{clients|proxies}/{id}/quota[/reset] (admin):
+//
+//	PUT    quota        {"daily_bytes":N,"monthly_bytes":N} → set limits, usage kept
+//	DELETE quota        → remove limits
+//	POST   quota/reset  → zero the usage counters
+func quotaAction(w http.ResponseWriter, r *http.Request, st store.Store, kind, id, action string) {
+	var q *types.Quota
+	switch {
+	case action == "" && r.Method == http.MethodPut:
+		q = &types.Quota{}
+		if err := json.NewDecoder(r.Body).Decode(q); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		if q.DailyBytes < 0 || q.MonthlyBytes < 0 {
+			httpx.JSON(w, 400, map[string]string{"error": "daily_bytes and monthly_bytes must be >= 0"})
+			return
+		}
+	case action == "" && r.Method == http.MethodDelete:
+	case action == "reset" && r.Method == http.MethodPost:
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	var out interface{}
+	ok := false
+	switch {
+	case kind == "client" && action == "reset":
+		out, ok = st.ResetClientQuota(id)
+	case kind == "client":
+		out, ok = st.SetClientQuota(id, q)
+	case action == "reset":
+		out, ok = st.ResetProxyQuota(id)
+	default:
+		out, ok = st.SetProxyQuota(id, q)
+	}
+	if !ok {
+		httpx.JSON(w, 404, map[string]string{"error": "not found"})
+		return
+	}
+	httpx.JSON(w, 200, out)
+}
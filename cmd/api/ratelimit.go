@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/httpx"
+	"github.com/Chinsusu/proxy-server-local/pkg/store"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// rateLimitAction serves PUT/DELETE /v1/clients/{id}/ratelimit (admin).
+// pgw-fwd picks the change up on its next reload, live connections included.
+func rateLimitAction(w http.ResponseWriter, r *http.Request, st store.Store, id string) {
+	l, ok := readRateLimit(w, r)
+	if !ok {
+		return
+	}
+	for _, c := range st.ListClients() {
+		if c.ID == id {
+			c.RateLimit = l
+			if c, ok := st.UpdateClient(c); ok {
+				httpx.JSON(w, 200, c)
+				return
+			}
+		}
+	}
+	httpx.JSON(w, 404, map[string]string{"error": "not found"})
+}
+
+// clientConnsAction serves PUT /v1/clients/{id}/conns {"max_conns":N} (admin):
+// the client's cap on concurrent connections, in place of pgw-fwd's
+// PGW_FWD_MAX_CONNS_PER_CLIENT.
+func clientConnsAction(w http.ResponseWriter, r *http.Request, st store.Store, id string) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(405)
+		return
+	}
+	var body struct {
+		MaxConns int `json:"max_conns"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+		return
+	}
+	if body.MaxConns < -1 {
+		httpx.JSON(w, 400, map[string]string{"error": "max_conns must be >= -1"})
+		return
+	}
+	for _, c := range st.ListClients() {
+		if c.ID == id {
+			c.MaxConns = body.MaxConns
+			if c, ok := st.UpdateClient(c); ok {
+				httpx.JSON(w, 200, c)
+				return
+			}
+		}
+	}
+	httpx.JSON(w, 404, map[string]string{"error": "not found"})
+}
+
+// readRateLimit decodes the body of a PUT, or returns nil for DELETE. It
+// writes the error response itself when it returns false.
+func readRateLimit(w http.ResponseWriter, r *http.Request) (*types.RateLimit, bool) {
+	switch r.Method {
+	case http.MethodDelete:
+		return nil, true
+	case http.MethodPut:
+	default:
+		w.WriteHeader(405)
+		return nil, false
+	}
+	var l types.RateLimit
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+		return nil, false
+	}
+	if err := validateRateLimit(&l); err != nil {
+		httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if l == (types.RateLimit{}) {
+		return nil, true
+	}
+	return &l, true
+}
+
+func validateRateLimit(l *types.RateLimit) error {
+	if l == nil {
+		return nil
+	}
+	if l.UpKbps < 0 || l.DownKbps < 0 || l.BurstKB < 0 {
+		return errors.New("up_kbps, down_kbps and burst_kb must be >= 0")
+	}
+	return nil
+}
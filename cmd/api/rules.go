@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/hostmatch"
+	"github.com/Chinsusu/proxy-server-local/pkg/httpx"
+	"github.com/Chinsusu/proxy-server-local/pkg/store"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// clientRules serves the per-client routing rules:
+//
+//	GET    /v1/clients/{id}/rules         → []Rule
+//	PUT    /v1/clients/{id}/rules         → replace the whole ordered list
+//	POST   /v1/clients/{id}/rules         → append one rule
+//	DELETE /v1/clients/{id}/rules/{rule}  → remove one rule
+func clientRules(w http.ResponseWriter, r *http.Request, st store.Store, id, ruleID string) {
+	var c types.Client
+	found := false
+	for _, v := range st.ListClients() {
+		if v.ID == id {
+			c = v
+			found = true
+			break
+		}
+	}
+	if !found {
+		httpx.JSON(w, 404, map[string]string{"error": "not found"})
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && ruleID == "":
+		out := c.Rules
+		if out == nil {
+			out = []types.Rule{}
+		}
+		httpx.JSON(w, 200, out)
+		return
+
+	case r.Method == http.MethodPut && ruleID == "":
+		var rules []types.Rule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		c.Rules = rules
+
+	case r.Method == http.MethodPost && ruleID == "":
+		var rule types.Rule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		rule.ID = ""
+		c.Rules = append(c.Rules, rule)
+
+	case r.Method == http.MethodDelete && ruleID != "":
+		kept := make([]types.Rule, 0, len(c.Rules))
+		for _, rule := range c.Rules {
+			if rule.ID != ruleID {
+				kept = append(kept, rule)
+			}
+		}
+		if len(kept) == len(c.Rules) {
+			httpx.JSON(w, 404, map[string]string{"error": "rule not found"})
+			return
+		}
+		c.Rules = kept
+
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	if err := validateRules(st, c.Rules); err != nil {
+		httpx.JSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	c, ok := st.UpdateClient(c)
+	if !ok {
+		httpx.JSON(w, 404, map[string]string{"error": "not found"})
+		return
+	}
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(204)
+		return
+	}
+	httpx.JSON(w, 200, c.Rules)
+}
+
+// validateRules checks every rule and assigns IDs to new ones.
+func validateRules(st store.Store, rules []types.Rule) error {
+	proxies := map[string]bool{}
+	for _, p := range st.ListProxies() {
+		proxies[p.ID] = true
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if _, err := hostmatch.Compile(rule.Match, rule.Pattern); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		switch rule.Action {
+		case "proxy":
+			if !proxies[rule.ProxyID] {
+				return fmt.Errorf("rule %d: unknown proxy_id %q", i+1, rule.ProxyID)
+			}
+		case "direct", "reject":
+			rule.ProxyID = ""
+		default:
+			return fmt.Errorf("rule %d: unsupported action: %s (supported: proxy, direct, reject)", i+1, rule.Action)
+		}
+		if rule.ID == "" {
+			rule.ID = uuid.New().String()
+		}
+	}
+	return nil
+}
@@ -6,27 +6,36 @@ import (
 	"strings"
 )
 
-// normalizeIPv4HostCIDR accepts "a.b.c.d" or "a.b.c.d/32" and returns "a.b.c.d/32".
-// Rejects any prefix other than /32 and any non-IPv4 address.
-func normalizeIPv4HostCIDR(in string) (string, error) {
+// normalizeHostCIDR accepts a single host, "a.b.c.d" / "a.b.c.d/32" or an
+// IPv6 address / "x::y/128", and returns it with its full-length prefix.
+// Rejects any shorter prefix.
+func normalizeHostCIDR(in string) (string, error) {
 	s := strings.TrimSpace(in)
 	if s == "" {
 		return "", fmt.Errorf("empty ip_cidr")
 	}
 	if !strings.Contains(s, "/") {
 		ip := net.ParseIP(s)
-		if ip == nil || ip.To4() == nil {
-			return "", fmt.Errorf("invalid IPv4")
+		if ip == nil {
+			return "", fmt.Errorf("invalid IP")
 		}
-		return ip.String() + "/32", nil
+		return hostCIDR(ip), nil
 	}
 	ip, ipnet, err := net.ParseCIDR(s)
-	if err != nil || ip == nil || ip.To4() == nil || ipnet == nil {
-		return "", fmt.Errorf("invalid IPv4 CIDR")
+	if err != nil || ip == nil || ipnet == nil {
+		return "", fmt.Errorf("invalid IP CIDR")
 	}
 	ones, bits := ipnet.Mask.Size()
-	if bits != 32 || ones != 32 {
-		return "", fmt.Errorf("only /32 allowed")
+	if ones != bits {
+		return "", fmt.Errorf("only /32 (IPv4) or /128 (IPv6) allowed")
 	}
-	return ip.String() + "/32", nil
+	return hostCIDR(ip), nil
+}
+
+// hostCIDR writes ip with its host prefix; IPv4-mapped IPv6 counts as IPv4.
+func hostCIDR(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String() + "/32"
+	}
+	return ip.String() + "/128"
 }
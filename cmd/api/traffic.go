@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/httpx"
+	"github.com/Chinsusu/proxy-server-local/pkg/store"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// traffic serves /v1/traffic:
+//
+//	GET  ?client_id=&proxy_id=&from=YYYY-MM-DD&to=YYYY-MM-DD&group=day|total
+//	POST []ConnRecord (pgw-fwd) → 204
+func traffic(w http.ResponseWriter, r *http.Request, st store.Store) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		for _, k := range []string{"from", "to"} {
+			if v := q.Get(k); v != "" {
+				if _, err := time.Parse("2006-01-02", v); err != nil {
+					httpx.JSON(w, 400, map[string]string{"error": k + " must be YYYY-MM-DD"})
+					return
+				}
+			}
+		}
+		rows := st.ListTraffic(q.Get("client_id"), q.Get("proxy_id"), q.Get("from"), q.Get("to"))
+		switch q.Get("group") {
+		case "", "day":
+			httpx.JSON(w, 200, rows)
+		case "total":
+			httpx.JSON(w, 200, trafficTotals(rows))
+		default:
+			httpx.JSON(w, 400, map[string]string{"error": "group must be day or total"})
+		}
+	case http.MethodPost:
+		var recs []types.ConnRecord
+		if err := json.NewDecoder(r.Body).Decode(&recs); err != nil {
+			httpx.JSON(w, 400, map[string]string{"error": "bad json"})
+			return
+		}
+		st.AddTraffic(recs)
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// trafficTotals sums daily rows per (client, proxy); Day is left empty.
+func trafficTotals(rows []types.TrafficStat) []types.TrafficStat {
+	sum := map[[2]string]types.TrafficStat{}
+	for _, t := range rows {
+		k := [2]string{t.ClientID, t.ProxyID}
+		a := sum[k]
+		a.ClientID, a.ProxyID = t.ClientID, t.ProxyID
+		a.Conns += t.Conns
+		a.BytesUp += t.BytesUp
+		a.BytesDown += t.BytesDown
+		a.DurationMs += t.DurationMs
+		sum[k] = a
+	}
+	out := make([]types.TrafficStat, 0, len(sum))
+	for _, a := range sum {
+		out = append(out, a)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ClientID != out[j].ClientID {
+			return out[i].ClientID < out[j].ClientID
+		}
+		return out[i].ProxyID < out[j].ProxyID
+	})
+	return out
+}
+
+// recentConns serves GET /v1/traffic/connections?client_id=&limit=N.
+func recentConns(w http.ResponseWriter, r *http.Request, st store.Store) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		return
+	}
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 {
+		limit = 100
+	}
+	cid := q.Get("client_id")
+	if cid == "" {
+		httpx.JSON(w, 200, st.RecentConns(limit))
+		return
+	}
+	out := []types.ConnRecord{}
+	for _, c := range st.RecentConns(0) {
+		if c.ClientID == cid {
+			out = append(out, c)
+			if len(out) == limit {
+				break
+			}
+		}
+	}
+	httpx.JSON(w, 200, out)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// affinity pins a (client IP, destination host) pair to the upstream it last
+// went out through, so sites that tie a session to the exit IP keep seeing
+// the same one while a mapping's pool rotates or fails over.
+var affinity = newAffinityTable()
+
+type affinityKey struct {
+	Client string
+	Host   string
+}
+
+type affinityEntry struct {
+	ProxyID string
+	Expires time.Time
+}
+
+// affinityView is one row of GET /fwd/affinity.
+type affinityView struct {
+	Client    string    `json:"client"`
+	Host      string    `json:"host"`
+	ProxyID   string    `json:"proxy_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type affinityTable struct {
+	mu sync.Mutex
+	m  map[affinityKey]affinityEntry
+}
+
+func newAffinityTable() *affinityTable {
+	return &affinityTable{m: map[affinityKey]affinityEntry{}}
+}
+
+func (t *affinityTable) get(client, host string) (string, bool) {
+	k := affinityKey{client, strings.ToLower(host)}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.m[k]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(e.Expires) {
+		delete(t.m, k)
+		return "", false
+	}
+	return e.ProxyID, true
+}
+
+// put records (or refreshes) a pin; every use extends it by ttl.
+func (t *affinityTable) put(client, host, proxyID string, ttl time.Duration) {
+	t.mu.Lock()
+	t.m[affinityKey{client, strings.ToLower(host)}] = affinityEntry{ProxyID: proxyID, Expires: time.Now().Add(ttl)}
+	t.mu.Unlock()
+}
+
+func (t *affinityTable) list() []affinityView {
+	now := time.Now()
+	t.mu.Lock()
+	out := make([]affinityView, 0, len(t.m))
+	for k, e := range t.m {
+		if now.After(e.Expires) {
+			continue
+		}
+		out = append(out, affinityView{Client: k.Client, Host: k.Host, ProxyID: e.ProxyID, ExpiresAt: e.Expires})
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Client != out[j].Client {
+			return out[i].Client < out[j].Client
+		}
+		return out[i].Host < out[j].Host
+	})
+	return out
+}
+
+// clear drops pins matching client and host; an empty filter matches all.
+func (t *affinityTable) clear(client, host string) int {
+	host = strings.ToLower(host)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for k := range t.m {
+		if (client == "" || k.Client == client) && (host == "" || k.Host == host) {
+			delete(t.m, k)
+			n++
+		}
+	}
+	return n
+}
+
+// sweep drops expired pins so the table does not grow with every host a
+// client ever visited.
+func (t *affinityTable) sweep(every time.Duration) {
+	tk := time.NewTicker(every)
+	defer tk.Stop()
+	for range tk.C {
+		now := time.Now()
+		t.mu.Lock()
+		for k, e := range t.m {
+			if now.After(e.Expires) {
+				delete(t.m, k)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// stickyOrder returns rt's pool with the pinned upstream (if still a member)
+// moved to the front; the rest stay in failover order.
+func stickyOrder(rt *route, client, host string) []upstream {
+	if rt.StickyTTL <= 0 || host == "" {
+		return rt.Pool
+	}
+	id, ok := affinity.get(client, host)
+	if !ok {
+		return rt.Pool
+	}
+	for i, up := range rt.Pool {
+		if up.ID == id {
+			if i == 0 {
+				return rt.Pool
+			}
+			out := make([]upstream, 0, len(rt.Pool))
+			out = append(out, up)
+			out = append(out, rt.Pool[:i]...)
+			return append(out, rt.Pool[i+1:]...)
+		}
+	}
+	return rt.Pool
+}
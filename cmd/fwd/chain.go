@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// dialHops dials hops[0] and tunnels through each hop in turn to target,
+// one nested handshake per hop, each CONNECTing to the next. A hop's
+// connection lives inside the previous hop's tunnel, so it is never redialed.
+// Hops that want a PROXY protocol header get one naming t's client.
+func dialHops(hops []upstream, target string, t *dialTarget) (net.Conn, error) {
+	pc, err := net.DialTimeout("tcp", hops[0].addr(), 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("dial chain hop %s: %w", hops[0].addr(), err)
+	}
+	for i := range hops {
+		next := target
+		if i+1 < len(hops) {
+			next = hops[i+1].addr()
+		}
+		if err = sendProxyHeader(pc, &hops[i], t); err == nil {
+			pc, err = handshake(pc, &hops[i])
+		}
+		if err == nil {
+			pc, err = request(pc, &hops[i], next, nil)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chain hop %d (%s): %w", i+1, &hops[i], err)
+		}
+	}
+	return pc, nil
+}
+
+// withChain resolves p.Chain against proxies into up.Chain. A missing or
+// disabled hop makes the whole chain unusable.
+func withChain(up upstream, p types.Proxy, proxies map[string]types.Proxy) (upstream, error) {
+	for _, id := range p.Chain {
+		hop, ok := proxies[id]
+		if !ok || !hop.Enabled {
+			return up, fmt.Errorf("chain hop %s missing or disabled", id)
+		}
+		up.Chain = append(up.Chain, toUpstream(hop))
+	}
+	return up, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/logging"
+)
+
+// connLimits caps concurrent connections per client IP and per local port.
+// Connections over a cap wait up to queue for a slot, then are refused. A
+// client's own max_conns (carried by its routes) replaces the per-client
+// default.
+var connLimits = newConnLimiter(
+	envInt("PGW_FWD_MAX_CONNS_PER_CLIENT", 0),
+	envInt("PGW_FWD_MAX_CONNS_PER_PORT", 0),
+	envDuration("PGW_FWD_CONN_QUEUE_TIMEOUT", 0),
+)
+
+type connLimiter struct {
+	perClient int // 0 = unlimited
+	perPort   int
+	queue     time.Duration
+
+	mu             sync.Mutex
+	wake           chan struct{} // closed and replaced on every release
+	byClient       map[string]int
+	byPort         map[int]int
+	rejectedClient map[string]int64
+	rejectedPort   map[int]int64
+	rejected       int64
+}
+
+// connStats is the body of GET /fwd/conns.
+type connStats struct {
+	MaxPerClient     int              `json:"max_per_client"`
+	MaxPerPort       int              `json:"max_per_port"`
+	QueueMs          int64            `json:"queue_ms"`
+	ActiveByClient   map[string]int   `json:"active_by_client"`
+	ActiveByPort     map[int]int      `json:"active_by_port"`
+	RejectedByClient map[string]int64 `json:"rejected_by_client"`
+	RejectedByPort   map[int]int64    `json:"rejected_by_port"`
+	RejectedTotal    int64            `json:"rejected_total"`
+}
+
+func newConnLimiter(perClient, perPort int, queue time.Duration) *connLimiter {
+	return &connLimiter{
+		perClient:      perClient,
+		perPort:        perPort,
+		queue:          queue,
+		wake:           make(chan struct{}),
+		byClient:       map[string]int{},
+		byPort:         map[int]int{},
+		rejectedClient: map[string]int64{},
+		rejectedPort:   map[int]int64{},
+	}
+}
+
+func envDuration(k string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(env(k, "")); err == nil && d >= 0 {
+		return d
+	}
+	return def
+}
+
+// acquire takes a slot for client on port, waiting up to the queue timeout
+// for one to free up. max is the client's own cap (0 = the default, -1 =
+// none). It reports false when the connection must be refused.
+func (l *connLimiter) acquire(client string, port, max int) bool {
+	if max == 0 {
+		max = l.perClient
+	}
+	var deadline <-chan time.Time
+	for {
+		l.mu.Lock()
+		if (max <= 0 || l.byClient[client] < max) && (l.perPort <= 0 || l.byPort[port] < l.perPort) {
+			l.byClient[client]++
+			l.byPort[port]++
+			l.mu.Unlock()
+			return true
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		if deadline == nil {
+			if l.queue <= 0 {
+				break
+			}
+			t := time.NewTimer(l.queue)
+			defer t.Stop()
+			deadline = t.C
+		}
+		select {
+		case <-wake:
+		case <-deadline:
+			l.reject(client, port)
+			return false
+		}
+	}
+	l.reject(client, port)
+	return false
+}
+
+func (l *connLimiter) reject(client string, port int) {
+	l.mu.Lock()
+	l.rejected++
+	l.rejectedClient[client]++
+	l.rejectedPort[port]++
+	n := l.rejectedClient[client]
+	l.mu.Unlock()
+	// a client hammering the limit would flood the log otherwise
+	if n == 1 || n%100 == 0 {
+		logging.Warn.Printf("[fwd] %s -> :%d refused: too many connections (%d refused so far)", client, port, n)
+	}
+}
+
+func (l *connLimiter) release(client string, port int) {
+	l.mu.Lock()
+	if l.byClient[client]--; l.byClient[client] <= 0 {
+		delete(l.byClient, client)
+	}
+	if l.byPort[port]--; l.byPort[port] <= 0 {
+		delete(l.byPort, port)
+	}
+	close(l.wake)
+	l.wake = make(chan struct{})
+	l.mu.Unlock()
+}
+
+func (l *connLimiter) stats() connStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := connStats{
+		MaxPerClient:     l.perClient,
+		MaxPerPort:       l.perPort,
+		QueueMs:          l.queue.Milliseconds(),
+		ActiveByClient:   make(map[string]int, len(l.byClient)),
+		ActiveByPort:     make(map[int]int, len(l.byPort)),
+		RejectedByClient: make(map[string]int64, len(l.rejectedClient)),
+		RejectedByPort:   make(map[int]int64, len(l.rejectedPort)),
+		RejectedTotal:    l.rejected,
+	}
+	for k, v := range l.byClient {
+		st.ActiveByClient[k] = v
+	}
+	for k, v := range l.byPort {
+		st.ActiveByPort[k] = v
+	}
+	for k, v := range l.rejectedClient {
+		st.RejectedByClient[k] = v
+	}
+	for k, v := range l.rejectedPort {
+		st.RejectedByPort[k] = v
+	}
+	return st
+}
+
+// clientIP is the host part of a connection's remote address.
+func clientIP(c net.Conn) string {
+	client := c.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(client); err == nil {
+		return h
+	}
+	return client
+}
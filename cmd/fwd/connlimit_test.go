@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnLimiterPerClient(t *testing.T) {
+	l := newConnLimiter(2, 0, 0)
+	for i := 0; i < 2; i++ {
+		if !l.acquire("10.0.0.1", 15001, 0) {
+			t.Fatalf("connection %d refused under the cap", i+1)
+		}
+	}
+	if l.acquire("10.0.0.1", 15002, 0) {
+		t.Fatal("third connection of the client accepted")
+	}
+	// the cap is per client
+	if !l.acquire("10.0.0.2", 15001, 0) {
+		t.Fatal("another client refused")
+	}
+	// a slot freed is usable again
+	l.release("10.0.0.1", 15001)
+	if !l.acquire("10.0.0.1", 15001, 0) {
+		t.Fatal("refused after a release")
+	}
+	st := l.stats()
+	if st.ActiveByClient["10.0.0.1"] != 2 || st.ActiveByClient["10.0.0.2"] != 1 || st.ActiveByPort[15001] != 3 {
+		t.Fatalf("active: %v %v", st.ActiveByClient, st.ActiveByPort)
+	}
+	if st.RejectedTotal != 1 || st.RejectedByClient["10.0.0.1"] != 1 || st.RejectedByPort[15002] != 1 {
+		t.Fatalf("rejected: %d %v %v", st.RejectedTotal, st.RejectedByClient, st.RejectedByPort)
+	}
+}
+
+func TestConnLimiterOwnMax(t *testing.T) {
+	l := newConnLimiter(1, 0, 0)
+	// the client's max_conns replaces the default
+	for i := 0; i < 3; i++ {
+		if !l.acquire("10.0.0.1", 15001, 3) {
+			t.Fatalf("connection %d refused under max_conns 3", i+1)
+		}
+	}
+	if l.acquire("10.0.0.1", 15001, 3) {
+		t.Fatal("fourth connection accepted with max_conns 3")
+	}
+	// -1 lifts the cap altogether
+	for i := 0; i < 10; i++ {
+		if !l.acquire("10.0.0.2", 15001, -1) {
+			t.Fatalf("connection %d refused with max_conns -1", i+1)
+		}
+	}
+}
+
+func TestConnLimiterPerPort(t *testing.T) {
+	l := newConnLimiter(0, 2, 0)
+	if !l.acquire("10.0.0.1", 15001, 0) || !l.acquire("10.0.0.2", 15001, 0) {
+		t.Fatal("refused under the port cap")
+	}
+	// the port cap holds across clients, even without a client cap
+	if l.acquire("10.0.0.3", 15001, -1) {
+		t.Fatal("third connection on the port accepted")
+	}
+	if !l.acquire("10.0.0.3", 15002, 0) {
+		t.Fatal("another port refused")
+	}
+}
+
+func TestConnLimiterQueue(t *testing.T) {
+	l := newConnLimiter(1, 0, 200*time.Millisecond)
+	l.acquire("10.0.0.1", 15001, 0)
+
+	// nothing frees up: refused after the queue timeout
+	start := time.Now()
+	if l.acquire("10.0.0.1", 15001, 0) {
+		t.Fatal("accepted over the cap")
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("refused after %v, before the queue timeout", d)
+	}
+
+	// a release while waiting lets the queued connection in
+	time.AfterFunc(50*time.Millisecond, func() { l.release("10.0.0.1", 15001) })
+	if !l.acquire("10.0.0.1", 15001, 0) {
+		t.Fatal("queued connection refused after a release")
+	}
+}
+
+func TestConnLimiterBackToZero(t *testing.T) {
+	l := newConnLimiter(5, 8, 50*time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}[i%3]
+			port := 15001 + i%2
+			if l.acquire(client, port, 0) {
+				time.Sleep(time.Millisecond)
+				l.release(client, port)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if st := l.stats(); len(st.ActiveByClient) != 0 || len(st.ActiveByPort) != 0 {
+		t.Fatalf("after every connection closed: %v %v", st.ActiveByClient, st.ActiveByPort)
+	}
+}
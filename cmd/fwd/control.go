@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/httpx"
+	"github.com/Chinsusu/proxy-server-local/pkg/logging"
+)
+
+// controlAddr is where serveControl ended up listening; the status file
+// carries it so pgw-api can find every forwarder (one per port in unit mode).
+var controlAddr atomic.Value // string
+
+// serveControl exposes the forwarder's in-memory state to pgw-api on a
+// loopback address. When PGW_AGENT_TOKEN is set callers must present it.
+func serveControl(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fwd/affinity", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			httpx.JSON(w, 200, affinity.list())
+		case http.MethodDelete:
+			q := r.URL.Query()
+			n := affinity.clear(q.Get("client"), q.Get("host"))
+			httpx.JSON(w, 200, map[string]int{"cleared": n})
+		default:
+			w.WriteHeader(405)
+		}
+	})
+	mux.HandleFunc("/fwd/status", func(w http.ResponseWriter, r *http.Request) {
+		httpx.JSON(w, 200, currentStatus())
+	})
+	mux.HandleFunc("/fwd/conns", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(405)
+			return
+		}
+		httpx.JSON(w, 200, connLimits.stats())
+	})
+	// after a handoff the previous process holds addr until it has drained
+	for warned := false; ; time.Sleep(2 * time.Second) {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			if !warned {
+				logging.Warn.Printf("[fwd] control %s: %v (retrying)", addr, err)
+				warned = true
+			}
+			continue
+		}
+		controlAddr.Store(ln.Addr().String())
+		logging.Info.Printf("pgw-fwd control on %s", ln.Addr())
+		if err := http.Serve(ln, controlAuth(mux)); err != nil {
+			logging.Error.Printf("[fwd] control %s: %v", addr, err)
+		}
+		return
+	}
+}
+
+func controlAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tok := os.Getenv("PGW_AGENT_TOKEN"); tok != "" {
+			if strings.TrimSpace(r.Header.Get("Authorization")) != "Bearer "+tok {
+				httpx.JSON(w, 401, map[string]string{"error": "unauthorized"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/logging"
+)
+
+// active counts connections being served, across all ports.
+var active atomic.Int64
+
+// live holds the client side of those connections, so a drain that times
+// out can cut them and still let each one record its traffic.
+var live = &connSet{m: map[net.Conn]struct{}{}}
+
+type connSet struct {
+	mu sync.Mutex
+	m  map[net.Conn]struct{}
+}
+
+func (s *connSet) add(c net.Conn) {
+	s.mu.Lock()
+	s.m[c] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *connSet) remove(c net.Conn) {
+	s.mu.Lock()
+	delete(s.m, c)
+	s.mu.Unlock()
+}
+
+func (s *connSet) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.m {
+		_ = c.Close()
+	}
+}
+
+// inherited holds listeners handed over by the previous pgw-fwd process
+// (PGW_FWD_INHERIT_FDS="port:fd,..."); handedOver is true in that process's
+// successor. Ports left unclaimed stay open until a sync has succeeded, so
+// an API that is down during the upgrade doesn't close them.
+var inherited, handedOver = loadInherited()
+
+func loadInherited() (map[int]net.Listener, bool) {
+	spec := os.Getenv("PGW_FWD_INHERIT_FDS")
+	if spec == "" {
+		return nil, false
+	}
+	os.Unsetenv("PGW_FWD_INHERIT_FDS")
+	out := map[int]net.Listener{}
+	for _, kv := range strings.Split(spec, ",") {
+		p, fd, ok := strings.Cut(kv, ":")
+		port, err1 := strconv.Atoi(p)
+		n, err2 := strconv.Atoi(fd)
+		if !ok || err1 != nil || err2 != nil {
+			logging.Warn.Printf("[fwd] bad inherited listener %q", kv)
+			continue
+		}
+		file := os.NewFile(uintptr(n), "listener:"+p)
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			logging.Warn.Printf("[fwd] inherited listener :%d: %v", port, err)
+			continue
+		}
+		out[port] = ln
+	}
+	return out, true
+}
+
+// listen returns the inherited listener for port, or opens addr.
+func listen(port int, addr string) (net.Listener, error) {
+	if ln, ok := inherited[port]; ok {
+		delete(inherited, port)
+		logging.Info.Printf("[fwd] took over listener :%d", port)
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// fwdStatus is what GET /fwd/status and the status file report.
+type fwdStatus struct {
+	PID       int       `json:"pid"`
+	State     string    `json:"state"` // "serving" | "draining"
+	Active    int64     `json:"active"`
+	Prewarmed int       `json:"prewarmed"`         // ready upstream sockets
+	Control   string    `json:"control,omitempty"` // control listener address
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var draining atomic.Bool
+
+func currentStatus() fwdStatus {
+	st := fwdStatus{PID: os.Getpid(), State: "serving", Active: active.Load(), Prewarmed: warm.ready(), UpdatedAt: time.Now()}
+	if draining.Load() {
+		st.State = "draining"
+	}
+	st.Control, _ = controlAddr.Load().(string)
+	return st
+}
+
+// statusPath is <PGW_FWD_STATUS_DIR>/fwd-<pid>.json; deploy scripts glob it.
+func statusPath() string {
+	return filepath.Join(env("PGW_FWD_STATUS_DIR", "/run/pgw"), fmt.Sprintf("fwd-%d.json", os.Getpid()))
+}
+
+func writeStatus() {
+	b, _ := json.Marshal(currentStatus())
+	path := statusPath()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err == nil {
+		_ = os.Rename(tmp, path)
+	}
+}
+
+func statusLoop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for range t.C {
+		writeStatus()
+	}
+}
+
+// run handles signals until the process should exit:
+//
+//	SIGTERM/SIGINT  stop accepting, wait for active connections to finish
+//	                (at most PGW_FWD_DRAIN_TIMEOUT), then exit
+//	SIGUSR2         start a new pgw-fwd on the same listeners (upgrade);
+//	                the new process sends us SIGTERM once it is serving
+func (f *forwarder) run(apiBase string) {
+	go statusLoop()
+	writeStatus()
+	if handedOver {
+		sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+		_ = syscall.Kill(os.Getppid(), syscall.SIGTERM)
+	} else {
+		sdNotify("READY=1")
+	}
+
+	replaced := false
+	sig := make(chan os.Signal, 4)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	for s := range sig {
+		if s == syscall.SIGUSR2 {
+			if err := f.handoff(); err != nil {
+				logging.Error.Printf("[fwd] handoff: %v", err)
+				continue
+			}
+			replaced = true
+			continue
+		}
+		break
+	}
+	signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+	f.drain(apiBase, envDuration("PGW_FWD_DRAIN_TIMEOUT", 30*time.Second), !replaced)
+}
+
+// drain closes every listener and waits for active connections to end.
+func (f *forwarder) drain(apiBase string, timeout time.Duration, notify bool) {
+	draining.Store(true)
+	f.mu.Lock()
+	for port, ln := range f.listeners {
+		_ = ln.Close()
+		delete(f.listeners, port)
+	}
+	f.mu.Unlock()
+	warm.close()
+	if notify {
+		sdNotify("STOPPING=1")
+	}
+
+	deadline := time.Now().Add(timeout)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for n := active.Load(); n > 0; n = active.Load() {
+		if time.Now().After(deadline) {
+			logging.Warn.Printf("[fwd] drain timeout after %s, cutting %d connections", timeout, n)
+			// closing the client side ends both splices; give the handlers
+			// a moment to record the traffic before it is flushed below
+			live.closeAll()
+			for cut := time.Now().Add(5 * time.Second); active.Load() > 0 && time.Now().Before(cut); {
+				time.Sleep(50 * time.Millisecond)
+			}
+			break
+		}
+		logging.Info.Printf("[fwd] draining: %d active", n)
+		writeStatus()
+		if notify {
+			sdNotify(fmt.Sprintf("STATUS=draining, %d active", n))
+		}
+		<-t.C
+	}
+	// don't lose what was counted since the last periodic report
+	flushNow(apiBase)
+	_ = os.Remove(statusPath())
+	logging.Info.Printf("[fwd] drained, exiting")
+}
+
+// handoff starts a copy of this binary that inherits every listener.
+func (f *forwarder) handoff() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	f.mu.RLock()
+	ports := make([]int, 0, len(f.listeners))
+	for port := range f.listeners {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	var files []*os.File
+	var spec []string
+	for _, port := range ports {
+		tl, ok := f.listeners[port].(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		file, err := tl.File()
+		if err != nil {
+			f.mu.RUnlock()
+			return fmt.Errorf("listener :%d: %w", port, err)
+		}
+		spec = append(spec, fmt.Sprintf("%d:%d", port, 3+len(files)))
+		files = append(files, file)
+	}
+	f.mu.RUnlock()
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), "PGW_FWD_INHERIT_FDS="+strings.Join(spec, ","))
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	logging.Info.Printf("[fwd] handed %d listeners to pid %d", len(files), cmd.Process.Pid)
+	go cmd.Wait()
+	return nil
+}
+
+// sdNotify sends a state update to systemd when running under Type=notify.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	_, _ = c.Write([]byte(state))
+}
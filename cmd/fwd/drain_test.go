@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+func portOf(ln net.Listener) int { return ln.Addr().(*net.TCPAddr).Port }
+
+func accepts(ln net.Listener) bool {
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+// After a handoff the new process keeps every inherited listener until a
+// sync succeeds; then it serves the mapped ports and closes the rest.
+func TestInheritedListenersSurviveFailedSync(t *testing.T) {
+	mapped, _ := net.Listen("tcp", "127.0.0.1:0")
+	unmapped, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func(m map[int]net.Listener) { inherited = m }(inherited)
+	inherited = map[int]net.Listener{portOf(mapped): mapped, portOf(unmapped): unmapped}
+
+	var up atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			http.Error(w, "starting", 503)
+			return
+		}
+		json.NewEncoder(w).Encode(types.FwdRoutes{Mappings: []types.MappingView{{
+			ID:                "m1",
+			Client:            types.Client{ID: "c1"},
+			Proxy:             types.Proxy{ID: "p1", Type: "http", Host: "127.0.0.1", Port: 3128, Enabled: true},
+			LocalRedirectPort: portOf(mapped),
+			PrewarmConns:      -1,
+		}}})
+	}))
+	defer srv.Close()
+
+	f := newForwarder(srv.URL, 0)
+	f.minPort, f.maxPort = 1, 65535
+	defer func() {
+		f.mu.Lock()
+		for _, ln := range f.listeners {
+			ln.Close()
+		}
+		f.mu.Unlock()
+	}()
+
+	if err := f.sync(); err == nil {
+		t.Fatal("sync succeeded with the API down")
+	}
+	if len(inherited) != 2 || !accepts(mapped) || !accepts(unmapped) {
+		t.Fatalf("inherited listeners closed after a failed sync: %v", inherited)
+	}
+
+	up.Store(true)
+	if err := f.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if f.listeners[portOf(mapped)] != mapped || !accepts(mapped) {
+		t.Fatal("mapped port not served from its inherited listener")
+	}
+	if len(inherited) != 0 || accepts(unmapped) {
+		t.Fatal("unmapped inherited listener still open")
+	}
+}
@@ -1,33 +1,52 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/base64"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net"
-	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 	"unsafe"
 
+	"github.com/Chinsusu/proxy-server-local/pkg/check"
 	"github.com/Chinsusu/proxy-server-local/pkg/logging"
+	"github.com/Chinsusu/proxy-server-local/pkg/proxyproto"
+	"github.com/Chinsusu/proxy-server-local/pkg/shadowsocks"
 	"github.com/Chinsusu/proxy-server-local/pkg/types"
 )
 
 const SO_ORIGINAL_DST = 80
 
+// IP6T_SO_ORIGINAL_DST is the IPv6 counterpart, read at the SOL_IPV6 level.
+const IP6T_SO_ORIGINAL_DST = 80
+
 type upstream struct {
-	Type string
-	Host string
-	Port int
-	User string
-	Pass string
+	ID            string // proxy id
+	Type          string
+	Host          string
+	Port          int
+	User          string
+	Pass          string
+	Limit         types.RateLimit // proxy-wide rate limit
+	TLS           types.ProxyTLS  // type "https"
+	SSH           types.ProxySSH  // type "ssh"
+	Cipher        string          // type "shadowsocks"
+	PlainHTTP     bool            // types "http"/"https": see forwardsHTTP
+	AuthScheme    string          // types "http"/"https": "" | "basic" | "digest"
+	ProxyProtocol int             // PROXY protocol version sent first; 0 = none
+	Chain         []upstream      // hops passed through, in order, before this proxy
+}
+
+// dialTarget is what a client connection asks of its upstream.
+type dialTarget struct {
+	src, dst  *net.TCPAddr // LAN client and SO_ORIGINAL_DST
+	name      string       // connect_by_host: ask for name:port instead of dst
+	plainHTTP bool         // the client speaks plain HTTP (see forwardsHTTP)
 }
 
 func env(k, def string) string {
@@ -37,61 +56,38 @@ func env(k, def string) string {
 	return def
 }
 
-func resolveUpstream(apiBase string, localPort int) (*upstream, error) {
-	req, _ := http.NewRequest(http.MethodGet, strings.TrimRight(apiBase, "/")+"/v1/mappings/active", nil)
-	req.Header.Set("Accept", "application/json")
-	if tok := os.Getenv("PGW_AGENT_TOKEN"); tok != "" {
-		req.Header.Set("Authorization", "Bearer "+tok)
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("fetch mappings: %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		b, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("mappings %s: %s", resp.Status, string(b))
+func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	if la, ok := conn.LocalAddr().(*net.TCPAddr); ok && la.IP.To4() == nil {
+		var addr syscall.RawSockaddrInet6
+		if err := getsockopt(conn, syscall.SOL_IPV6, IP6T_SO_ORIGINAL_DST, unsafe.Pointer(&addr), unsafe.Sizeof(addr)); err != nil {
+			return nil, err
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, addr.Addr[:])
+		return &net.TCPAddr{IP: ip, Port: netPort(addr.Port)}, nil
 	}
-	var mvs []types.MappingView
-	if err := json.NewDecoder(resp.Body).Decode(&mvs); err != nil {
+	var addr syscall.RawSockaddrInet4
+	if err := getsockopt(conn, syscall.SOL_IP, SO_ORIGINAL_DST, unsafe.Pointer(&addr), unsafe.Sizeof(addr)); err != nil {
 		return nil, err
 	}
-	for _, mv := range mvs {
-		if mv.LocalRedirectPort == localPort && mv.Proxy.Enabled {
-			user := ""
-			pass := ""
-			if mv.Proxy.Username != nil {
-				user = *mv.Proxy.Username
-			}
-			if mv.Proxy.Password != nil {
-				pass = *mv.Proxy.Password
-			}
-			return &upstream{
-				Type: mv.Proxy.Type,
-				Host: mv.Proxy.Host,
-				Port: mv.Proxy.Port,
-				User: user,
-				Pass: pass,
-			}, nil
-		}
-	}
-	return nil, fmt.Errorf("no mapping for local port %d", localPort)
+	ip := net.IPv4(addr.Addr[0], addr.Addr[1], addr.Addr[2], addr.Addr[3])
+	return &net.TCPAddr{IP: ip, Port: netPort(addr.Port)}, nil
 }
 
-func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
-	var addr syscall.RawSockaddrInet4
-	sz := uint32(unsafe.Sizeof(addr))
+// getsockopt reads a socket option of conn into the size bytes at p.
+func getsockopt(conn *net.TCPConn, level, opt int, p unsafe.Pointer, size uintptr) error {
+	sz := uint32(size)
 	var serr error
 	rc, err := conn.SyscallConn()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	err = rc.Control(func(fd uintptr) {
 		_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT,
 			fd,
-			uintptr(syscall.SOL_IP),
-			uintptr(SO_ORIGINAL_DST),
-			uintptr(unsafe.Pointer(&addr)),
+			uintptr(level),
+			uintptr(opt),
+			uintptr(p),
 			uintptr(unsafe.Pointer(&sz)),
 			0,
 		)
@@ -100,85 +96,67 @@ func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
 		}
 	})
 	if err != nil {
-		return nil, err
-	}
-	if serr != nil {
-		return nil, serr
+		return err
 	}
-	ip := net.IPv4(addr.Addr[0], addr.Addr[1], addr.Addr[2], addr.Addr[3])
-	port := int(binary.BigEndian.Uint16((*(*[2]byte)(unsafe.Pointer(&addr.Port)))[:]))
-	return &net.TCPAddr{IP: ip, Port: port}, nil
+	return serr
 }
 
-func dialViaProxy(up *upstream, dst *net.TCPAddr) (net.Conn, error) {
-	proxyAddr := fmt.Sprintf("%s:%d", up.Host, up.Port)
-	pc, err := net.DialTimeout("tcp", proxyAddr, 10*time.Second)
-	if err != nil {
-		return nil, fmt.Errorf("dial proxy %s: %w", proxyAddr, err)
-	}
-	dstHP := net.JoinHostPort(dst.IP.String(), fmt.Sprintf("%d", dst.Port))
-	auth := ""
-	if up.User != "" || up.Pass != "" {
-		b64 := base64.StdEncoding.EncodeToString([]byte(up.User + ":" + up.Pass))
-		auth = "Proxy-Authorization: Basic " + b64 + "\r\n"
-	}
-	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n%sProxy-Connection: Keep-Alive\r\nConnection: Keep-Alive\r\n\r\n",
-		dstHP, dstHP, auth)
-	if _, err := io.WriteString(pc, req); err != nil {
-		pc.Close()
-		return nil, fmt.Errorf("write CONNECT: %w", err)
-	}
-	br := bufio.NewReader(pc)
-	status, err := br.ReadString('\n')
+// netPort converts a port in network byte order as stored in a sockaddr.
+func netPort(p uint16) int {
+	return int(binary.BigEndian.Uint16((*(*[2]byte)(unsafe.Pointer(&p)))[:]))
+}
+
+// connectViaProxy sends CONNECT dstHP over pc, already connected (and for
+// "https", TLS-wrapped) to an http proxy. A 407 challenge is answered, on a
+// connection from redial if the proxy closes this one. pc is closed on
+// failure.
+func connectViaProxy(pc net.Conn, up *upstream, dstHP string, redial func() (net.Conn, error)) (net.Conn, error) {
+	if redial == nil {
+		return check.ProxyConnect(pc, dstHP, up.User, up.Pass, up.AuthScheme, nil)
+	}
+	return check.ProxyConnect(pc, dstHP, up.User, up.Pass, up.AuthScheme, func() (net.Conn, error) {
+		c, err := redial()
+		if err == nil {
+			_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+		}
+		return c, err
+	})
+}
+
+// connectViaSOCKS5 sends the SOCKS5 CONNECT dstHP over pc, after
+// socks5Handshake. pc is closed on failure.
+func connectViaSOCKS5(pc net.Conn, up *upstream, dstHP string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(dstHP)
 	if err != nil {
 		pc.Close()
-		return nil, fmt.Errorf("read CONNECT status: %w", err)
+		return nil, err
 	}
-	if !strings.HasPrefix(status, "HTTP/1.1 200") && !strings.HasPrefix(status, "HTTP/1.0 200") {
-		// drain headers
-		for {
-			line, e := br.ReadString('\n')
-			if e != nil || line == "\r\n" {
-				break
-			}
-		}
+	port, _ := strconv.Atoi(portStr)
+	if err := socks5Connect(pc, host, port); err != nil {
 		pc.Close()
-		return nil, fmt.Errorf("proxy refused CONNECT: %s", strings.TrimSpace(status))
-	}
-	// consume remaining headers
-	for {
-		line, e := br.ReadString('\n')
-		if e != nil {
-			pc.Close()
-			return nil, fmt.Errorf("read headers: %w", e)
-		}
-		if line == "\r\n" {
-			break
-		}
+		return nil, fmt.Errorf("SOCKS5 connect failed: %w", err)
 	}
 	return pc, nil
 }
 
-func dialViaSOCKS5(up *upstream, dst *net.TCPAddr) (net.Conn, error) {
-	proxyAddr := fmt.Sprintf("%s:%d", up.Host, up.Port)
-	pc, err := net.DialTimeout("tcp", proxyAddr, 10*time.Second)
-	if err != nil {
-		return nil, fmt.Errorf("dial SOCKS5 proxy %s: %w", proxyAddr, err)
-	}
-
-	// SOCKS5 handshake
-	if err := socks5Handshake(pc, up.User, up.Pass); err != nil {
+// connectViaSOCKS4 sends a SOCKS4/4a CONNECT dstHP over pc; up.User is the
+// userid. pc is closed on failure.
+func connectViaSOCKS4(pc net.Conn, up *upstream, dstHP string) (net.Conn, error) {
+	if err := check.SOCKS4Connect(pc, dstHP, up.User); err != nil {
 		pc.Close()
-		return nil, fmt.Errorf("SOCKS5 handshake failed: %w", err)
+		return nil, fmt.Errorf("SOCKS4 connect failed: %w", err)
 	}
+	return pc, nil
+}
 
-	// SOCKS5 connect request
-	if err := socks5Connect(pc, dst.IP.String(), dst.Port); err != nil {
-		pc.Close()
-		return nil, fmt.Errorf("SOCKS5 connect failed: %w", err)
+// connectViaShadowsocks wraps pc in up's cipher and requests dstHP. pc is
+// closed on failure.
+func connectViaShadowsocks(pc net.Conn, up *upstream, dstHP string) (net.Conn, error) {
+	sc, err := shadowsocks.Tunnel(pc, up.Cipher, up.Pass, dstHP)
+	if err != nil {
+		return nil, fmt.Errorf("shadowsocks request failed: %w", err)
 	}
-
-	return pc, nil
+	return sc, nil
 }
 
 func socks5Handshake(conn net.Conn, username, password string) error {
@@ -324,6 +302,26 @@ func socks5Connect(conn net.Conn, host string, port int) error {
 	return nil
 }
 
+// validHostname reports whether h, taken from SNI or Host, is a DNS name the
+// upstream can be asked to resolve (not an IP literal, no stray bytes).
+func validHostname(h string) bool {
+	if h == "" || len(h) > 253 || net.ParseIP(h) != nil {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(h, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func parseHTTPHost(b []byte) (string, bool) {
 	// read up to first \r\n\r\n
 	idx := bytes.Index(b, []byte("\r\n\r\n"))
@@ -455,13 +453,164 @@ func maskHost(h string) string {
 	return strings.Join(parts, ".")
 }
 
-func splice(dst, src net.Conn) {
-	_ = dst.SetDeadline(time.Now().Add(10 * time.Minute))
-	_ = src.SetDeadline(time.Now().Add(10 * time.Minute))
-	io.Copy(dst, src)
+func (up *upstream) addr() string { return net.JoinHostPort(up.Host, strconv.Itoa(up.Port)) }
+
+func (up *upstream) String() string {
+	if up.Type == "direct" {
+		return "direct"
+	}
+	s := fmt.Sprintf("%s %s", up.Type, up.addr())
+	for i := range up.Chain {
+		if i == 0 {
+			s += " via "
+		} else {
+			s += " > "
+		}
+		s += up.Chain[i].String()
+	}
+	return s
+}
+
+// prepare connects to up, through its chain if any, and runs the part of
+// its protocol that does not depend on the destination. The result is
+// what the prewarm pool keeps ready. t is nil when no client is waiting.
+func prepare(up *upstream, t *dialTarget) (net.Conn, error) {
+	var pc net.Conn
+	var err error
+	if len(up.Chain) > 0 {
+		pc, err = dialHops(up.Chain, up.addr(), t)
+	} else {
+		pc, err = net.DialTimeout("tcp", up.addr(), 10*time.Second)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dial %s proxy %s: %w", up.Type, up.addr(), err)
+	}
+	if err := sendProxyHeader(pc, up, t); err != nil {
+		return nil, err
+	}
+	return handshake(pc, up)
+}
+
+// sendProxyHeader starts pc with up's PROXY protocol header, if it wants
+// one, naming t's client and original destination (UNKNOWN / LOCAL with no
+// t). pc is closed on failure.
+func sendProxyHeader(pc net.Conn, up *upstream, t *dialTarget) error {
+	if up.ProxyProtocol == 0 {
+		return nil
+	}
+	var src, dst *net.TCPAddr
+	if t != nil {
+		src, dst = t.src, t.dst
+	}
+	_ = pc.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := proxyproto.Write(pc, up.ProxyProtocol, src, dst); err != nil {
+		pc.Close()
+		return fmt.Errorf("PROXY header to %s: %w", up.addr(), err)
+	}
+	_ = pc.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+// handshake sets up TLS to an "https" proxy or the SOCKS5 greeting and
+// auth on pc; other types have nothing to do before the request. pc is
+// closed on failure.
+func handshake(pc net.Conn, up *upstream) (net.Conn, error) {
+	var err error
+	switch up.Type {
+	case "https":
+		if pc, err = proxyTLS(pc, up); err != nil {
+			return nil, fmt.Errorf("tls to proxy %s: %w", up.addr(), err)
+		}
+	case "socks5":
+		_ = pc.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := socks5Handshake(pc, up.User, up.Pass); err != nil {
+			pc.Close()
+			return nil, fmt.Errorf("SOCKS5 handshake failed: %w", err)
+		}
+		_ = pc.SetDeadline(time.Time{})
+	}
+	return pc, nil
+}
+
+// request asks up, over a handshaken pc, for a tunnel to dstHP. redial
+// prepares a replacement for pc when the protocol needs one (a Digest
+// challenge on a closed connection); nil when pc cannot be replaced.
+func request(pc net.Conn, up *upstream, dstHP string, redial func() (net.Conn, error)) (net.Conn, error) {
+	_ = pc.SetDeadline(time.Now().Add(10 * time.Second))
+	var err error
+	switch up.Type {
+	case "socks5":
+		pc, err = connectViaSOCKS5(pc, up, dstHP)
+	case "socks4":
+		pc, err = connectViaSOCKS4(pc, up, dstHP)
+	case "shadowsocks":
+		pc, err = connectViaShadowsocks(pc, up, dstHP)
+	case "http", "https":
+		pc, err = connectViaProxy(pc, up, dstHP, redial)
+	default:
+		pc.Close()
+		return nil, fmt.Errorf("unsupported upstream type %q", up.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = pc.SetDeadline(time.Time{})
+	return pc, nil
+}
+
+// dialUpstream opens a tunnel to t.dst through up. A non-empty t.name asks
+// the proxy for name:port instead, so it resolves the host near the exit;
+// direct connections always go to the original IP. With t.plainHTTP an
+// upstream that forwardsHTTP gets no tunnel: the connection to the proxy
+// itself is returned, for relayHTTP.
+func dialUpstream(up *upstream, t *dialTarget) (net.Conn, error) {
+	target := t.dst.String()
+	if t.name != "" {
+		target = net.JoinHostPort(t.name, strconv.Itoa(t.dst.Port))
+	}
+	switch up.Type {
+	case "direct":
+		return net.DialTimeout("tcp", t.dst.String(), 10*time.Second)
+	case "ssh":
+		return dialViaSSH(up, target) // dials its own chain, once per session
+	}
+	if t.plainHTTP && up.forwardsHTTP() {
+		// a fresh socket: a stale pooled one would only show on the first request
+		return prepare(up, t)
+	}
+	redial := func() (net.Conn, error) { return prepare(up, t) }
+	pc, warmed, err := warm.take(up, t)
+	if err != nil {
+		return nil, err
+	}
+	c, err := request(pc, up, target, redial)
+	if err != nil && warmed {
+		// the proxy may have dropped the idle socket; retry on a fresh one
+		if pc, err = prepare(up, t); err != nil {
+			return nil, err
+		}
+		c, err = request(pc, up, target, redial)
+	}
+	return c, err
 }
 
-func handleConn(c net.Conn, up *upstream) {
+// dialPool tries each upstream of pool in order and returns the first tunnel
+// that comes up, so a flapping member only costs one failed dial.
+func dialPool(pool []upstream, t *dialTarget) (net.Conn, *upstream, error) {
+	var lastErr error
+	for i := range pool {
+		up := &pool[i]
+		pc, err := dialUpstream(up, t)
+		if err == nil {
+			return pc, up, nil
+		}
+		lastErr = err
+		logging.Error.Printf("[fwd] CONNECT %s via %s failed: %v", t.dst.String(), up, err)
+	}
+	return nil, nil, lastErr
+}
+
+func handleConn(c net.Conn, rt *route) {
 	tc, ok := c.(*net.TCPConn)
 	if !ok {
 		c.Close()
@@ -475,74 +624,177 @@ func handleConn(c net.Conn, up *upstream) {
 		return
 	}
 
-	var pc net.Conn
-	if up.Type == "socks5" {
-		pc, err = dialViaSOCKS5(up, dst)
-	} else {
-		pc, err = dialViaProxy(up, dst)
-	}
-
-	if err != nil {
-		logging.Error.Printf("[fwd] CONNECT %s via %s %s:%d failed: %v", dst.String(), up.Type, up.Host, up.Port, err)
-		return
-	}
-
-	// Peek a little from client to extract Host/SNI, forward those bytes to proxy, then splice
+	// Peek a little from client to extract Host/SNI before picking the
+	// upstream (affinity, rules and policies need it); the bytes are replayed
+	// to the proxy.
 	var host string
+	var plainHTTP bool
 	buf := make([]byte, 2048)
-	_ = c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
-	n, _ := c.Read(buf)
-	_ = c.SetReadDeadline(time.Time{})
+	n := 0
+	if rt.needsPeek() {
+		_ = c.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		n, _ = c.Read(buf)
+		_ = c.SetReadDeadline(time.Time{})
+	}
 	if n > 0 {
 		if h, ok := parseHTTPHost(buf[:n]); ok {
-			host = h
+			host, plainHTTP = h, true
 		} else if h, ok := parseTLSSNI(buf[:n]); ok {
 			host = h
 		}
-		// forward preface to proxy
+	}
+
+	client := clientIP(c)
+	if rt.Blocked != "" {
+		logging.Info.Printf("[fwd] %s -> %s host=%s rejected: %s", client, dst.String(), maskHost(host), rt.Blocked)
+		rejectConn(c, buf[:n])
+		return
+	}
+	if ok, why := checkPolicy(rt.ClientID, host); !ok {
+		logging.Info.Printf("[fwd] %s -> %s host=%s rejected: %s", client, dst.String(), maskHost(host), why)
+		rejectConn(c, buf[:n])
+		return
+	}
+	pool := stickyOrder(rt, client, host)
+	sticky := rt.StickyTTL > 0 && host != ""
+	if rule := rt.matchRule(host); rule != nil {
+		if rule.Action == "reject" {
+			logging.Info.Printf("[fwd] %s -> %s host=%s rejected by rule %s", client, dst.String(), maskHost(host), rule.ID)
+			rejectConn(c, buf[:n])
+			return
+		}
+		pool = []upstream{rule.Upstream}
+		sticky = false
+	}
+	t := &dialTarget{dst: dst, plainHTTP: plainHTTP}
+	t.src, _ = c.RemoteAddr().(*net.TCPAddr)
+	if rt.ByHost && validHostname(host) {
+		t.name = host
+	}
+	start := time.Now()
+	pc, up, err := dialPool(pool, t)
+	if err != nil {
+		if len(pool) > 1 {
+			logging.Error.Printf("[fwd] CONNECT %s: all %d upstreams failed", dst.String(), len(pool))
+		}
+		return
+	}
+	defer pc.Close()
+	if sticky {
+		affinity.put(client, host, up.ID, rt.StickyTTL)
+	}
+
+	// forward preface to proxy; relayHTTP rewrites it with the rest
+	relay := plainHTTP && up.forwardsHTTP()
+	if n > 0 && !relay {
 		if _, err := pc.Write(buf[:n]); err != nil {
 			logging.Error.Printf("[fwd] prewrite to proxy failed: %v", err)
 			return
 		}
 	}
 
-	if host != "" {
-		logging.Info.Printf("[fwd] %s -> %s host=%s via %s %s:%d OK",
-			c.RemoteAddr().String(), dst.String(), maskHost(host), up.Type, up.Host, up.Port)
+	if relay {
+		logging.Info.Printf("[fwd] %s -> %s host=%s via %s OK (plain http)",
+			c.RemoteAddr().String(), dst.String(), maskHost(host), up)
+	} else if host != "" {
+		logging.Info.Printf("[fwd] %s -> %s host=%s via %s OK",
+			c.RemoteAddr().String(), dst.String(), maskHost(host), up)
 	} else {
-		logging.Info.Printf("[fwd] %s -> %s via %s %s:%d OK",
-			c.RemoteAddr().String(), dst.String(), up.Type, up.Host, up.Port)
+		logging.Info.Printf("[fwd] %s -> %s via %s OK",
+			c.RemoteAddr().String(), dst.String(), up)
 	}
 
-	// splice both directions
-	go splice(pc, c) // proxy -> client
-	splice(c, pc)    // client -> proxy
+	// shape per client (or mapping) and per proxy
+	cs := shapers.get(rt.shapeKey())
+	upLim, downLim := []*bucket{&cs.up}, []*bucket{&cs.down}
+	if up.ID != "" {
+		ps := shapers.get("proxy:" + up.ID)
+		upLim, downLim = append(upLim, &ps.up), append(downLim, &ps.down)
+	}
+
+	// splice both directions; each side's EOF is passed on as a half-close
+	setKeepAlive(c)
+	setKeepAlive(pc)
+	act := newActivity(rt.idleTimeout())
+	upc := make(chan int64, 1)
+	go func() { // client -> proxy
+		if relay {
+			upc <- relayHTTP(pc, c, buf[:n], up, dst, act, upLim...)
+		} else {
+			upc <- int64(n) + splice(pc, c, act, upLim...)
+		}
+	}()
+	down := splice(c, pc, act, downLim...) // proxy -> client
+	bytesUp := <-upc
+
+	end := time.Now()
+	traffic.record(types.ConnRecord{
+		ClientID:  rt.ClientID,
+		ClientIP:  client,
+		MappingID: rt.MappingID,
+		ProxyID:   up.ID,
+		Upstream:  up.String(),
+		Dst:       dst.String(),
+		Host:      maskHost(host),
+		BytesUp:   bytesUp,
+		BytesDown: down,
+		Start:     start,
+		End:       end,
+	})
+	logging.Info.Printf("[fwd] %s -> %s closed up=%d down=%d in %s", client, dst.String(), bytesUp, down, end.Sub(start).Round(time.Millisecond))
 }
 
 func main() {
 	addr := env("PGW_FWD_ADDR", ":15001")
 	api := env("PGW_API_BASE", "http://127.0.0.1:8080")
 
+	multi := env("PGW_FWD_MODE", "unit") == "multi"
+	go affinity.sweep(time.Minute)
+	go flushPolicyHits(api, 30*time.Second)
+	go flushTraffic(api, 30*time.Second)
+	go warm.run()
+	// every pgw-fwd@<port> unit gets a loopback port of its own, announced
+	// in its status file; multi-port mode keeps the well-known one
+	ctlDefault := "127.0.0.1:0"
+	if multi {
+		ctlDefault = "127.0.0.1:9091"
+	}
+	if ctl := env("PGW_FWD_CONTROL_ADDR", ctlDefault); ctl != "off" {
+		go serveControl(ctl)
+	}
+
+	if multi {
+		f := newForwarder(api, 0)
+		if err := f.sync(); err != nil {
+			logging.Warn.Printf("[fwd] initial routes: %v", err)
+		}
+		logging.Info.Printf("pgw-fwd multi-port mode, ports %d-%d (transparent CONNECT+SNI)", f.minPort, f.maxPort)
+		go f.watch(reloadInterval())
+		f.run(api)
+		return
+	}
+
 	localPort := 15001
-	if strings.HasPrefix(addr, ":") {
-		fmt.Sscanf(addr, ":%d", &localPort)
+	if _, p, err := net.SplitHostPort(addr); err == nil {
+		if n, err := strconv.Atoi(p); err == nil {
+			localPort = n
+		}
 	}
-	up, err := resolveUpstream(api, localPort)
-	if err != nil {
+	f := newForwarder(api, localPort)
+	if err := f.sync(); err != nil {
 		logging.Error.Fatalf("[fwd] resolve upstream: %v", err)
 	}
+	go f.watch(reloadInterval())
 
-	ln, err := net.Listen("tcp", addr)
+	ln, err := listen(localPort, addr)
 	if err != nil {
 		logging.Error.Fatalf("[fwd] listen %s: %v", addr, err)
 	}
+	f.mu.Lock()
+	f.listeners[localPort] = ln
+	f.mu.Unlock()
+	up := f.routeFor(localPort).primary()
 	logging.Info.Printf("pgw-fwd listening %s (transparent CONNECT+SNI) → %s proxy %s:%d", addr, up.Type, up.Host, up.Port)
-
-	for {
-		c, err := ln.Accept()
-		if err != nil {
-			continue
-		}
-		go handleConn(c, up)
-	}
+	go f.serve(ln, localPort)
+	f.run(api)
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+)
+
+// forwardsHTTP tells whether plain HTTP through up goes as absolute-URI
+// requests to the proxy itself instead of through a CONNECT tunnel; many
+// providers refuse CONNECT to port 80. The requests carry Basic
+// credentials, so a Digest proxy always gets CONNECT.
+func (up *upstream) forwardsHTTP() bool {
+	return up.PlainHTTP && (up.Type == "http" || up.Type == "https") && up.AuthScheme != "digest"
+}
+
+// relayHTTP is the client -> proxy half of a plain-HTTP connection: it
+// reads each request from the client (the peeked preface first), rewrites
+// it to absolute-URI form with our Proxy-Authorization and writes it to pc,
+// so keep-alive and pipelined requests all get rewritten. Responses need
+// no change and come back through splice. An Upgrade request (websocket)
+// switches the rest of the stream to a raw copy. It returns the bytes read
+// from the client (preface included), not the rewritten ones, so traffic
+// and quotas count what the client sent; like splice it half-closes pc on a
+// clean EOF and tears down both sides on anything else.
+func relayHTTP(pc, c net.Conn, preface []byte, up *upstream, dst *net.TCPAddr, act *activity, limits ...*bucket) int64 {
+	var r io.Reader = idleReader{c, act}
+	if len(limits) > 0 {
+		r = shapedReader{r, limits}
+	}
+	cr := &countReader{r: r}
+	br := bufio.NewReader(io.MultiReader(bytes.NewReader(preface), cr))
+	if err := forwardRequests(pc, br, up, dst); err == nil {
+		if cw, ok := pc.(closeWriter); ok && cw.CloseWrite() == nil {
+			return int64(len(preface)) + cr.n
+		}
+	}
+	c.Close()
+	pc.Close()
+	return int64(len(preface)) + cr.n
+}
+
+func forwardRequests(w io.Writer, br *bufio.Reader, up *upstream, dst *net.TCPAddr) error {
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return err
+		}
+		absoluteURI(req, dst)
+		req.Header.Del("Proxy-Authorization")
+		if up.User != "" || up.Pass != "" {
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(up.User+":"+up.Pass)))
+		}
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// keep net/http from adding its own
+			req.Header["User-Agent"] = []string{""}
+		}
+		upgrade := req.Header.Get("Upgrade") != ""
+		if err := req.WriteProxy(w); err != nil {
+			return err
+		}
+		if upgrade {
+			_, err := io.Copy(w, br)
+			return err
+		}
+	}
+}
+
+// absoluteURI makes an origin-form request absolute. WriteProxy takes the
+// authority from the Host header, so the proxy resolves the name the client
+// asked for (and virtual hosting works); a request without Host goes to the
+// original IP and port.
+func absoluteURI(req *http.Request, dst *net.TCPAddr) {
+	if req.URL.IsAbs() {
+		return
+	}
+	req.URL.Scheme = "http"
+	req.URL.Host = dst.String()
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
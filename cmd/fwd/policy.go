@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/hostmatch"
+	"github.com/Chinsusu/proxy-server-local/pkg/logging"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// policies is the domain deny/allow set currently enforced; it is swapped
+// as a whole on every route sync.
+var policies atomic.Pointer[policySet]
+
+type compiledPolicy struct {
+	types.DomainPolicy
+	m *hostmatch.Matcher
+}
+
+type policyList struct {
+	deny  []compiledPolicy
+	allow []compiledPolicy
+}
+
+type policySet struct {
+	global    policyList
+	perClient map[string]*policyList
+}
+
+// compilePolicies prepares the policies fetched from the API. Policies that
+// no longer compile are skipped so the rest keep working.
+func compilePolicies(ps []types.DomainPolicy) *policySet {
+	set := &policySet{perClient: map[string]*policyList{}}
+	for _, p := range ps {
+		m, err := hostmatch.Compile(p.Match, p.Pattern)
+		if err != nil {
+			logging.Warn.Printf("[fwd] skip policy %s: %v", p.ID, err)
+			continue
+		}
+		l := &set.global
+		if p.ClientID != "" {
+			if set.perClient[p.ClientID] == nil {
+				set.perClient[p.ClientID] = &policyList{}
+			}
+			l = set.perClient[p.ClientID]
+		}
+		cp := compiledPolicy{DomainPolicy: p, m: m}
+		switch p.List {
+		case "deny":
+			l.deny = append(l.deny, cp)
+		case "allow":
+			l.allow = append(l.allow, cp)
+		}
+	}
+	return set
+}
+
+func matchPolicy(ps []compiledPolicy, host string) *compiledPolicy {
+	for i := range ps {
+		if ps[i].m.Match(host) {
+			return &ps[i]
+		}
+	}
+	return nil
+}
+
+// hasPolicies tells whether any policy applies to the client's connections.
+func hasPolicies(clientID string) bool {
+	set := policies.Load()
+	if set == nil {
+		return false
+	}
+	l := set.perClient[clientID]
+	return len(set.global.deny)+len(set.global.allow) > 0 || (l != nil && len(l.deny)+len(l.allow) > 0)
+}
+
+// checkPolicy decides whether a client of clientID may reach host. Deny
+// entries (global, then the client's) win; when any allowlist applies the
+// host must match one of its entries, so an unknown host is denied. The
+// returned reason names the policy for the reject log.
+func checkPolicy(clientID, host string) (bool, string) {
+	set := policies.Load()
+	if set == nil {
+		return true, ""
+	}
+	lists := []*policyList{&set.global}
+	if l := set.perClient[clientID]; l != nil {
+		lists = append(lists, l)
+	}
+	for _, l := range lists {
+		if p := matchPolicy(l.deny, host); p != nil {
+			policyHits.add(p.ID)
+			return false, "deny " + p.ID
+		}
+	}
+	restricted := false
+	for _, l := range lists {
+		if len(l.allow) == 0 {
+			continue
+		}
+		restricted = true
+		if p := matchPolicy(l.allow, host); p != nil {
+			policyHits.add(p.ID)
+			return true, ""
+		}
+	}
+	if restricted {
+		return false, "not in allowlist"
+	}
+	return true, ""
+}
+
+// rejectConn refuses a connection in the client's own protocol where it can:
+// a TLS access_denied alert after a ClientHello, 403 for plain HTTP,
+// otherwise a bare close.
+func rejectConn(c net.Conn, preface []byte) {
+	_ = c.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	switch {
+	case len(preface) > 0 && preface[0] == 0x16:
+		_, _ = c.Write([]byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x31})
+	case bytes.Contains(preface, []byte(" HTTP/")):
+		body := "blocked by proxy policy\n"
+		_, _ = fmt.Fprintf(c, "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+	}
+}
+
+// policyHits counts matches per policy until they are flushed to the API.
+var policyHits = &hitCounter{m: map[string]int64{}}
+
+type hitCounter struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+func (h *hitCounter) add(id string) {
+	h.mu.Lock()
+	h.m[id]++
+	h.mu.Unlock()
+}
+
+func (h *hitCounter) take() map[string]int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := h.m
+	h.m = map[string]int64{}
+	return out
+}
+
+func (h *hitCounter) merge(m map[string]int64) {
+	h.mu.Lock()
+	for id, n := range m {
+		h.m[id] += n
+	}
+	h.mu.Unlock()
+}
+
+// flushPolicyHits reports hit counters to the API every interval. Counts
+// that fail to post are kept for the next round.
+func flushPolicyHits(apiBase string, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		reportPolicyHits(apiBase)
+	}
+}
+
+func reportPolicyHits(apiBase string) {
+	hits := policyHits.take()
+	if len(hits) == 0 {
+		return
+	}
+	if err := apiPost(apiBase, "/v1/policies/hits", hits); err != nil {
+		logging.Warn.Printf("[fwd] report policy hits: %v", err)
+		policyHits.merge(hits)
+	}
+}
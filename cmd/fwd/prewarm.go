@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/logging"
+)
+
+var (
+	// prewarmSize is how many ready sockets are kept per mapping upstream;
+	// 0 = off. A mapping's prewarm_conns overrides it.
+	prewarmSize = envInt("PGW_FWD_PREWARM", 0)
+	// prewarmMaxIdle discards ready sockets older than this, before the
+	// proxy is likely to time them out itself.
+	prewarmMaxIdle = envDuration("PGW_FWD_PREWARM_MAX_IDLE", 30*time.Second)
+)
+
+// warm keeps pre-dialed upstream sockets, handshaken up to the point where
+// only the destination is missing (see prepare), for each mapping's
+// primary upstream.
+var warm = &warmPool{sets: map[string]*warmSet{}, kickc: make(chan struct{}, 1)}
+
+type warmPool struct {
+	mu     sync.Mutex
+	sets   map[string]*warmSet // by upstream key
+	closed bool
+	kickc  chan struct{}
+}
+
+type warmSet struct {
+	up      upstream
+	size    int
+	idle    []warmConn // oldest first
+	dialing int
+	failAt  time.Time
+}
+
+type warmConn struct {
+	c  net.Conn
+	at time.Time
+}
+
+func (rt *route) prewarm() int {
+	if rt.Prewarm != 0 {
+		return rt.Prewarm
+	}
+	return prewarmSize
+}
+
+// key identifies an upstream with everything that goes into prepare.
+func (up *upstream) key() string { return fmt.Sprintf("%+v", *up) }
+
+// warmable tells whether up's sockets can be prepared ahead of a client; a
+// PROXY protocol header names the client, so it cannot.
+func warmable(up *upstream) bool {
+	if up.Type == "direct" || up.Type == "ssh" || up.ProxyProtocol != 0 {
+		return false
+	}
+	for i := range up.Chain {
+		if up.Chain[i].ProxyProtocol != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// apply sets the pools wanted by routes and drops the others.
+func (p *warmPool) apply(routes map[int]*route) {
+	want := map[string]*warmSet{}
+	for _, rt := range routes {
+		n := rt.prewarm()
+		up := rt.primary()
+		if n <= 0 || rt.Blocked != "" || !warmable(&up) {
+			continue
+		}
+		k := up.key()
+		if w, ok := want[k]; !ok || w.size < n {
+			want[k] = &warmSet{up: up, size: n}
+		}
+	}
+	p.mu.Lock()
+	for k, s := range p.sets {
+		if _, ok := want[k]; !ok {
+			s.closeIdle()
+			delete(p.sets, k)
+		}
+	}
+	for k, w := range want {
+		if s, ok := p.sets[k]; ok {
+			s.size = w.size
+		} else {
+			p.sets[k] = w
+		}
+	}
+	p.mu.Unlock()
+	p.kick()
+}
+
+// take returns a ready socket for up, or prepares one now for t; warmed
+// tells which, so a stale pooled socket can be retried.
+func (p *warmPool) take(up *upstream, t *dialTarget) (c net.Conn, warmed bool, err error) {
+	p.mu.Lock()
+	if s, ok := p.sets[up.key()]; ok {
+		s.expire()
+		if n := len(s.idle); n > 0 {
+			c = s.idle[n-1].c
+			s.idle = s.idle[:n-1]
+		}
+	}
+	p.mu.Unlock()
+	if c != nil {
+		p.kick()
+		return c, true, nil
+	}
+	c, err = prepare(up, t)
+	return c, false, err
+}
+
+func (p *warmPool) kick() {
+	select {
+	case p.kickc <- struct{}{}:
+	default:
+	}
+}
+
+// run refills the pools in the background until close.
+func (p *warmPool) run() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-p.kickc:
+		}
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+		for k, s := range p.sets {
+			s.expire()
+			// back off for a while after a failed dial
+			for len(s.idle)+s.dialing < s.size && time.Since(s.failAt) > 5*time.Second {
+				s.dialing++
+				go p.fill(k, s)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *warmPool) fill(k string, s *warmSet) {
+	c, err := prepare(&s.up, nil)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.dialing--
+	if err != nil {
+		if time.Since(s.failAt) > time.Minute {
+			logging.Warn.Printf("[fwd] prewarm %s: %v", &s.up, err)
+		}
+		s.failAt = time.Now()
+		return
+	}
+	if p.closed || p.sets[k] != s || len(s.idle) >= s.size {
+		c.Close()
+		return
+	}
+	s.idle = append(s.idle, warmConn{c, time.Now()})
+}
+
+// close stops refilling and closes every idle socket.
+func (p *warmPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for k, s := range p.sets {
+		s.closeIdle()
+		delete(p.sets, k)
+	}
+}
+
+// ready returns the number of idle ready sockets.
+func (p *warmPool) ready() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, s := range p.sets {
+		n += len(s.idle)
+	}
+	return n
+}
+
+func (s *warmSet) expire() {
+	i := 0
+	for i < len(s.idle) && time.Since(s.idle[i].at) > prewarmMaxIdle {
+		s.idle[i].c.Close()
+		i++
+	}
+	s.idle = s.idle[i:]
+}
+
+func (s *warmSet) closeIdle() {
+	for _, w := range s.idle {
+		w.c.Close()
+	}
+	s.idle = nil
+}
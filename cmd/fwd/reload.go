@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/logging"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// forwarder owns the local port → upstream table. In single-port mode
+// (pgw-fwd@<port>) it serves one listener opened by main; in multi-port mode
+// it opens and closes listeners itself as mappings come and go.
+type forwarder struct {
+	apiBase  string
+	fixed    int // single-port mode: the only port served; 0 = multi-port
+	bindHost string
+	minPort  int
+	maxPort  int
+
+	// the last GET /v1/fwd/routes answer and its ETag (sync only)
+	config *types.FwdRoutes
+	etag   string
+
+	mu        sync.RWMutex
+	routes    map[int]*route
+	listeners map[int]net.Listener
+	conns     map[string]int // per mapping, since last connection-count rotation
+}
+
+func newForwarder(apiBase string, fixed int) *forwarder {
+	f := &forwarder{
+		apiBase:   apiBase,
+		fixed:     fixed,
+		bindHost:  env("PGW_FWD_LISTEN_HOST", ""),
+		minPort:   envInt("PGW_FWD_BASE_PORT", 15001),
+		maxPort:   envInt("PGW_FWD_MAX_PORT", 15999),
+		routes:    map[int]*route{},
+		listeners: map[int]net.Listener{},
+		conns:     map[string]int{},
+	}
+	if f.maxPort < f.minPort {
+		f.maxPort = f.minPort
+	}
+	return f
+}
+
+func envInt(k string, def int) int {
+	if n, err := strconv.Atoi(env(k, "")); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+func reloadInterval() time.Duration {
+	if d, err := time.ParseDuration(env("PGW_FWD_RELOAD_INTERVAL", "5s")); err == nil && d > 0 {
+		return d
+	}
+	return 5 * time.Second
+}
+
+// route is what a local port forwards to: the mapping's enabled upstreams in
+// failover order, tried in turn until one accepts the tunnel.
+type route struct {
+	MappingID   string
+	ClientID    string
+	Pool        []upstream
+	RotateEvery int           // connection-count rotation: ask the API to rotate after this many
+	StickyTTL   time.Duration // host affinity; 0 = off
+	Rules       []routeRule   // client's domain rules, first match wins
+	Blocked     string        // non-empty: refuse new connections (quota exceeded)
+	Limit       types.RateLimit
+	OwnLimit    bool          // Limit is the mapping's override rather than the client's
+	IdleTimeout time.Duration // 0 = forwarder default
+	ByHost      bool          // CONNECT by SNI/Host name rather than the original IP
+	Prewarm     int           // ready sockets to keep; 0 = PGW_FWD_PREWARM, -1 = off
+	MaxConns    int           // client's concurrent connection cap; 0 = PGW_FWD_MAX_CONNS_PER_CLIENT, -1 = none
+}
+
+func (r *route) primary() upstream { return r.Pool[0] }
+
+// needsPeek tells whether handling a connection depends on the SNI/Host in
+// the client's first bytes. When it doesn't the upstream is dialed right
+// away, so server-first protocols (SMTP, SSH, ...) don't wait on a peek.
+func (r *route) needsPeek() bool {
+	if r.Blocked != "" || r.StickyTTL > 0 || len(r.Rules) > 0 || r.ByHost || hasPolicies(r.ClientID) {
+		return true
+	}
+	for i := range r.Pool {
+		if r.Pool[i].forwardsHTTP() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *route) equal(o *route) bool {
+	if r.MappingID != o.MappingID || r.ClientID != o.ClientID || r.Blocked != o.Blocked || r.Limit != o.Limit || r.OwnLimit != o.OwnLimit || r.IdleTimeout != o.IdleTimeout || r.ByHost != o.ByHost || r.Prewarm != o.Prewarm || r.MaxConns != o.MaxConns || r.RotateEvery != o.RotateEvery || r.StickyTTL != o.StickyTTL || len(r.Pool) != len(o.Pool) {
+		return false
+	}
+	for i := range r.Pool {
+		if !reflect.DeepEqual(r.Pool[i], o.Pool[i]) {
+			return false
+		}
+	}
+	if len(r.Rules) != len(o.Rules) {
+		return false
+	}
+	for i := range r.Rules {
+		if r.Rules[i].Rule != o.Rules[i].Rule || !reflect.DeepEqual(r.Rules[i].Upstream, o.Rules[i].Upstream) {
+			return false
+		}
+	}
+	return true
+}
+
+func toUpstream(p types.Proxy) upstream {
+	user := ""
+	pass := ""
+	if p.Username != nil {
+		user = *p.Username
+	}
+	if p.Password != nil {
+		pass = *p.Password
+	}
+	up := upstream{
+		ID:            p.ID,
+		Type:          p.Type,
+		Host:          p.Host,
+		Port:          p.Port,
+		User:          user,
+		Pass:          pass,
+		Cipher:        p.Cipher,
+		PlainHTTP:     p.PlainHTTP,
+		AuthScheme:    p.AuthScheme,
+		ProxyProtocol: p.ProxyProtocol,
+	}
+	if p.RateLimit != nil {
+		up.Limit = *p.RateLimit
+	}
+	if p.TLS != nil {
+		up.TLS = *p.TLS
+	}
+	if p.SSH != nil {
+		up.SSH = *p.SSH
+	}
+	return up
+}
+
+// apiPost sends body as JSON to path on the API with the agent token.
+func apiPost(apiBase, path string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, _ := http.NewRequest(http.MethodPost, strings.TrimRight(apiBase, "/")+path, bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	if tok := os.Getenv("PGW_AGENT_TOKEN"); tok != "" {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("post %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s", path, resp.Status, string(b))
+	}
+	return nil
+}
+
+// fetchConfig returns what the routes are built from. It asks with the
+// ETag of the last answer, so while nothing changes the API only has to
+// answer 304 and the last answer is used again.
+func (f *forwarder) fetchConfig() (*types.FwdRoutes, error) {
+	const path = "/v1/fwd/routes"
+	req, _ := http.NewRequest(http.MethodGet, strings.TrimRight(f.apiBase, "/")+path, nil)
+	req.Header.Set("Accept", "application/json")
+	if tok := os.Getenv("PGW_AGENT_TOKEN"); tok != "" {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	if f.config != nil && f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && f.config != nil {
+		return f.config, nil
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s %s: %s", path, resp.Status, string(b))
+	}
+	var cfg types.FwdRoutes
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	f.config, f.etag = &cfg, resp.Header.Get("ETag")
+	return &cfg, nil
+}
+
+// buildRoutes returns the route of every mapping in cfg keyed by local port.
+// When several mappings share a port the first one listed by the API wins.
+// It runs on every sync, cached answer or not, since quotas run out and
+// reset with time.
+func buildRoutes(cfg *types.FwdRoutes) map[int]*route {
+	// proxies resolve "proxy" routing rules and chains
+	proxies := map[string]types.Proxy{}
+	for _, p := range cfg.Proxies {
+		proxies[p.ID] = p
+	}
+	now := time.Now()
+	routes := map[int]*route{}
+	for _, mv := range cfg.Mappings {
+		if mv.LocalRedirectPort <= 0 {
+			continue
+		}
+		if _, ok := routes[mv.LocalRedirectPort]; ok {
+			continue
+		}
+		rt := &route{
+			MappingID:   mv.ID,
+			ClientID:    mv.Client.ID,
+			StickyTTL:   time.Duration(mv.StickyTTLSec) * time.Second,
+			IdleTimeout: time.Duration(mv.IdleTimeoutSec) * time.Second,
+			ByHost:      mv.ConnectByHost,
+			Prewarm:     mv.PrewarmConns,
+			MaxConns:    mv.Client.MaxConns,
+		}
+		if rot := mv.Rotation; rot != nil && rot.Mode == "connections" && len(mv.Backups) > 0 {
+			rt.RotateEvery = rot.EveryConns
+		}
+		// members over their quota drop out of the pool
+		var spent []upstream
+		for _, p := range mv.Pool() {
+			if !p.Enabled {
+				continue
+			}
+			up, err := withChain(toUpstream(p), p, proxies)
+			switch {
+			case err != nil:
+				logging.Warn.Printf("[fwd] mapping %s: skip proxy %s: %v", mv.ID, p.ID, err)
+			case p.Quota.Exceeded(now):
+				spent = append(spent, up)
+			default:
+				rt.Pool = append(rt.Pool, up)
+			}
+		}
+		if len(rt.Pool) == 0 {
+			if len(spent) == 0 {
+				continue
+			}
+			rt.Pool, rt.Blocked = spent, "proxy quota exceeded"
+		}
+		if mv.RateLimit != nil {
+			rt.Limit, rt.OwnLimit = *mv.RateLimit, true
+		} else if mv.Client.RateLimit != nil {
+			rt.Limit = *mv.Client.RateLimit
+		}
+		if q := mv.Quota; q != nil && q.Exceeded {
+			rt.Blocked = q.Reason + " exceeded"
+		}
+		rt.Rules = compileRules(mv.Client.Rules, proxies)
+		routes[mv.LocalRedirectPort] = rt
+	}
+	return routes
+}
+
+// routeFor returns the route new connections on port should use.
+func (f *forwarder) routeFor(port int) *route {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.routes[port]
+}
+
+// sync refreshes the route table from the API. Errors keep the last known
+// routes so a restarting API does not cut clients off. Connections already
+// spliced keep the upstream they started with and drain on their own.
+func (f *forwarder) sync() error {
+	cfg, err := f.fetchConfig()
+	if err != nil {
+		return err
+	}
+	routes := buildRoutes(cfg)
+	policies.Store(compilePolicies(cfg.Policies))
+	if f.fixed > 0 {
+		rt, ok := routes[f.fixed]
+		if !ok {
+			return fmt.Errorf("no mapping for local port %d", f.fixed)
+		}
+		routes = map[int]*route{f.fixed: rt}
+	} else {
+		for port := range routes {
+			if port < f.minPort || port > f.maxPort {
+				delete(routes, port)
+			}
+		}
+	}
+
+	f.mu.Lock()
+	old := f.routes
+	f.routes = routes
+	f.mu.Unlock()
+	shapers.apply(routes)
+	warm.apply(routes)
+
+	for port, rt := range routes {
+		if prev, ok := old[port]; ok && !prev.equal(rt) {
+			was, now := prev.primary(), rt.primary()
+			if rt.Blocked != prev.Blocked {
+				if rt.Blocked != "" {
+					logging.Warn.Printf("[fwd] :%d blocked: %s", port, rt.Blocked)
+				} else {
+					logging.Info.Printf("[fwd] :%d unblocked", port)
+				}
+			}
+			logging.Info.Printf("[fwd] :%d upstream changed %s %s:%d → %s %s:%d (pool %d)", port, was.Type, was.Host, was.Port, now.Type, now.Host, now.Port, len(rt.Pool))
+		}
+	}
+	if f.fixed == 0 {
+		f.syncListeners(routes)
+	}
+	return nil
+}
+
+// syncListeners opens a listener for every routed port and closes the ones
+// whose mapping is gone, inherited ones included (multi-port mode only).
+func (f *forwarder) syncListeners(routes map[int]*route) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if draining.Load() {
+		return
+	}
+	for port, rt := range routes {
+		if _, ok := f.listeners[port]; ok {
+			continue
+		}
+		addr := net.JoinHostPort(f.bindHost, strconv.Itoa(port))
+		ln, err := listen(port, addr)
+		if err != nil {
+			logging.Error.Printf("[fwd] listen %s: %v", addr, err)
+			continue
+		}
+		f.listeners[port] = ln
+		up := rt.primary()
+		logging.Info.Printf("[fwd] listening %s → %s proxy %s:%d", addr, up.Type, up.Host, up.Port)
+		go f.serve(ln, port)
+	}
+	for port, ln := range f.listeners {
+		if _, ok := routes[port]; ok {
+			continue
+		}
+		_ = ln.Close()
+		delete(f.listeners, port)
+		logging.Info.Printf("[fwd] closed :%d (no mapping)", port)
+	}
+	for port, ln := range inherited {
+		_ = ln.Close()
+		delete(inherited, port)
+		logging.Info.Printf("[fwd] closed inherited :%d (no mapping)", port)
+	}
+}
+
+func (f *forwarder) watch(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		if err := f.sync(); err != nil {
+			logging.Warn.Printf("[fwd] reload routes: %v (keeping current)", err)
+		}
+	}
+}
+
+// serve accepts on ln until it is closed, handing each connection the
+// route currently set for port.
+func (f *forwarder) serve(ln net.Listener, port int) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		rt := f.routeFor(port)
+		if rt == nil {
+			c.Close()
+			continue
+		}
+		active.Add(1)
+		live.add(c)
+		go func() {
+			defer active.Add(-1)
+			defer live.remove(c)
+			client := clientIP(c)
+			if !connLimits.acquire(client, port, rt.MaxConns) {
+				c.Close()
+				return
+			}
+			defer connLimits.release(client, port)
+			f.countConn(rt)
+			handleConn(c, rt)
+		}()
+	}
+}
+
+// countConn implements connection-count rotation: every RotateEvery accepted
+// connections the API is asked to move the mapping to its next proxy.
+func (f *forwarder) countConn(rt *route) {
+	if rt.RotateEvery <= 0 {
+		return
+	}
+	f.mu.Lock()
+	f.conns[rt.MappingID]++
+	due := f.conns[rt.MappingID] >= rt.RotateEvery
+	if due {
+		f.conns[rt.MappingID] = 0
+	}
+	f.mu.Unlock()
+	if due {
+		go f.rotate(rt.MappingID)
+	}
+}
+
+func (f *forwarder) rotate(mappingID string) {
+	req, _ := http.NewRequest(http.MethodPost, strings.TrimRight(f.apiBase, "/")+"/v1/mappings/"+mappingID+"/rotate", nil)
+	if tok := os.Getenv("PGW_AGENT_TOKEN"); tok != "" {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logging.Warn.Printf("[fwd] rotate mapping %s: %v", mappingID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logging.Warn.Printf("[fwd] rotate mapping %s: %s", mappingID, resp.Status)
+		return
+	}
+	// pick up the new active proxy now rather than on the next poll
+	if err := f.sync(); err != nil {
+		logging.Warn.Printf("[fwd] reload routes: %v (keeping current)", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// An unchanged config costs one request answered 304, and the routes are
+// still rebuilt from the kept answer.
+func TestSyncReusesConfigOnNotModified(t *testing.T) {
+	cfg := types.FwdRoutes{Mappings: []types.MappingView{{
+		ID:                "m1",
+		Client:            types.Client{ID: "c1"},
+		Proxy:             types.Proxy{ID: "p1", Type: "http", Host: "127.0.0.1", Port: 3128, Enabled: true},
+		LocalRedirectPort: 15001,
+		PrewarmConns:      -1,
+	}}}
+	var full, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/fwd/routes" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		json.NewEncoder(w).Encode(cfg)
+	}))
+	defer srv.Close()
+
+	f := newForwarder(srv.URL, 15001)
+	for i := 0; i < 3; i++ {
+		if err := f.sync(); err != nil {
+			t.Fatal(err)
+		}
+		if rt := f.routeFor(15001); rt == nil || rt.MappingID != "m1" {
+			t.Fatalf("sync %d: route %+v", i+1, rt)
+		}
+	}
+	if full != 1 || notModified != 2 {
+		t.Fatalf("%d full answers, %d 304s; want 1 and 2", full, notModified)
+	}
+}
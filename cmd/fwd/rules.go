@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/Chinsusu/proxy-server-local/pkg/hostmatch"
+	"github.com/Chinsusu/proxy-server-local/pkg/logging"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// routeRule is a client routing rule ready to match: the pattern compiled
+// and, for action "proxy", the target proxy resolved to an upstream.
+type routeRule struct {
+	types.Rule
+	Upstream upstream
+	m        *hostmatch.Matcher
+}
+
+// compileRules prepares a client's rules. Rules that no longer compile or
+// point at a missing/disabled proxy are skipped so the rest keep working.
+func compileRules(rules []types.Rule, proxies map[string]types.Proxy) []routeRule {
+	var out []routeRule
+	for _, r := range rules {
+		m, err := hostmatch.Compile(r.Match, r.Pattern)
+		if err != nil {
+			logging.Warn.Printf("[fwd] skip rule %s: %v", r.ID, err)
+			continue
+		}
+		rr := routeRule{Rule: r, m: m}
+		switch r.Action {
+		case "proxy":
+			p, ok := proxies[r.ProxyID]
+			if !ok || !p.Enabled {
+				logging.Warn.Printf("[fwd] skip rule %s: proxy %s missing or disabled", r.ID, r.ProxyID)
+				continue
+			}
+			up, err := withChain(toUpstream(p), p, proxies)
+			if err != nil {
+				logging.Warn.Printf("[fwd] skip rule %s: %v", r.ID, err)
+				continue
+			}
+			rr.Upstream = up
+		case "direct":
+			rr.Upstream = upstream{Type: "direct"}
+		case "reject":
+		default:
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// matchRule returns the first rule of rt matching host, or nil.
+func (rt *route) matchRule(host string) *routeRule {
+	if host == "" {
+		return nil
+	}
+	for i := range rt.Rules {
+		if rt.Rules[i].m.Match(host) {
+			return &rt.Rules[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// bucket is a token bucket in bytes. Callers may overdraw it; they then
+// sleep until the debt is paid back, so a chunk larger than the burst still
+// goes through at the configured rate. A zero rate lets everything pass.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) set(kbps, burstKB int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = float64(kbps) * 1000 / 8
+	b.burst = float64(burstKB) * 1024
+	if b.burst <= 0 {
+		b.burst = b.rate
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// refill adds the tokens earned since the last call; a bucket used for the
+// first time starts full, so a new client gets its burst right away.
+func (b *bucket) refill(now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = b.burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// take charges n bytes and blocks while the bucket is in debt. The wait is
+// re-evaluated in short steps so rate changes apply to live connections.
+func (b *bucket) take(n int) {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	for b.rate > 0 && b.tokens < 0 {
+		wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+		if wait > 250*time.Millisecond {
+			wait = 250 * time.Millisecond
+		}
+		b.mu.Unlock()
+		time.Sleep(wait)
+		b.mu.Lock()
+		b.refill(time.Now())
+	}
+	b.mu.Unlock()
+}
+
+// shaper holds the two directions of one rate limit.
+type shaper struct {
+	up, down bucket
+}
+
+func (s *shaper) set(l types.RateLimit) {
+	s.up.set(l.UpKbps, l.BurstKB)
+	s.down.set(l.DownKbps, l.BurstKB)
+}
+
+// shapers keeps one shaper per client (or mapping override) and per proxy.
+// Entries are never dropped while running: connections hold on to them,
+// and a limit that goes away just turns into a zero rate.
+var shapers = &shaperSet{m: map[string]*shaper{}}
+
+type shaperSet struct {
+	mu sync.Mutex
+	m  map[string]*shaper
+}
+
+func (s *shaperSet) get(key string) *shaper {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.m[key]
+	if !ok {
+		sh = &shaper{}
+		s.m[key] = sh
+	}
+	return sh
+}
+
+// apply sets every shaper to the limits found in routes.
+func (s *shaperSet) apply(routes map[int]*route) {
+	want := map[string]types.RateLimit{}
+	for _, rt := range routes {
+		want[rt.shapeKey()] = rt.Limit
+		for _, up := range rt.Pool {
+			if up.ID != "" {
+				want["proxy:"+up.ID] = up.Limit
+			}
+		}
+		for _, rr := range rt.Rules {
+			if rr.Upstream.ID != "" {
+				want["proxy:"+rr.Upstream.ID] = rr.Upstream.Limit
+			}
+		}
+	}
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.m))
+	for k := range s.m {
+		keys = append(keys, k)
+	}
+	s.mu.Unlock()
+	for _, k := range keys {
+		if _, ok := want[k]; !ok {
+			s.get(k).set(types.RateLimit{})
+		}
+	}
+	for k, l := range want {
+		s.get(k).set(l)
+	}
+}
+
+// shapeKey names the bucket the route's client traffic draws from: the
+// mapping's own when it overrides the client's limit, else the client's.
+func (rt *route) shapeKey() string {
+	if rt.OwnLimit {
+		return "mapping:" + rt.MappingID
+	}
+	return "client:" + rt.ClientID
+}
+
+// shapedReader charges every read to the given buckets.
+type shapedReader struct {
+	r  io.Reader
+	bs []*bucket
+}
+
+func (s shapedReader) Read(p []byte) (int, error) {
+	// small reads keep the shaping smooth
+	if len(p) > 16*1024 {
+		p = p[:16*1024]
+	}
+	n, err := s.r.Read(p)
+	for _, b := range s.bs {
+		b.take(n)
+	}
+	return n, err
+}
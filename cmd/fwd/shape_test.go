@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	var b bucket
+	b.set(800, 10) // 100000 bytes/s, 10 KiB burst
+
+	// a fresh bucket starts full: the burst goes through at once
+	start := time.Now()
+	b.take(10 * 1024)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("first burst took %v", d)
+	}
+
+	// then reads are held to the rate: 50000 bytes take about half a second
+	start = time.Now()
+	n, err := io.Copy(io.Discard, shapedReader{r: bytes.NewReader(make([]byte, 50000)), bs: []*bucket{&b}})
+	if err != nil || n != 50000 {
+		t.Fatalf("copied %d, %v", n, err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > time.Second {
+		t.Fatalf("50000 bytes at 100000 bytes/s took %v", d)
+	}
+}
+
+func TestBucketZeroRate(t *testing.T) {
+	var b bucket
+	b.set(0, 0)
+	start := time.Now()
+	b.take(1 << 30)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("unlimited bucket blocked for %v", d)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// defaultIdleTimeout applies to mappings without idle_timeout_sec.
+	defaultIdleTimeout = envDuration("PGW_FWD_IDLE_TIMEOUT", 10*time.Minute)
+	// keepAlive is the TCP keepalive idle time on both legs; 0 disables.
+	keepAlive = envDuration("PGW_FWD_TCP_KEEPALIVE", 30*time.Second)
+)
+
+func (rt *route) idleTimeout() time.Duration {
+	if rt.IdleTimeout > 0 {
+		return rt.IdleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+func setKeepAlive(c net.Conn) {
+	// unwrap TLS / Shadowsocks down to the socket
+	for {
+		w, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		c = w.NetConn()
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if keepAlive <= 0 {
+		_ = tc.SetKeepAlive(false)
+		return
+	}
+	_ = tc.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: keepAlive, Interval: keepAlive / 3, Count: 3})
+}
+
+// activity is shared by both directions of a connection: it only counts
+// as idle when neither side has moved a byte for the whole timeout, so a
+// one-way stream (server push, downloads) stays up.
+type activity struct {
+	idle time.Duration
+	last atomic.Int64 // unix nanos
+}
+
+func newActivity(idle time.Duration) *activity {
+	a := &activity{idle: idle}
+	a.touch()
+	return a
+}
+
+func (a *activity) touch() { a.last.Store(time.Now().UnixNano()) }
+
+func (a *activity) quietFor() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// idleReader reads from c with an activity-refreshed deadline.
+type idleReader struct {
+	c   net.Conn
+	act *activity
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	for {
+		if r.act.idle > 0 {
+			_ = r.c.SetReadDeadline(time.Now().Add(r.act.idle - r.act.quietFor()))
+		}
+		n, err := r.c.Read(p)
+		if n > 0 {
+			r.act.touch()
+		}
+		if err != nil && n == 0 && errors.Is(err, os.ErrDeadlineExceeded) && r.act.quietFor() < r.act.idle {
+			// the other direction kept the connection alive
+			continue
+		}
+		return n, err
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice copies src to dst, drawing on the given rate-limit buckets, and
+// returns the number of bytes copied. A clean EOF from src is passed on as
+// a half-close of dst so the other direction can finish; an error or idle
+// timeout tears down both connections.
+func splice(dst, src net.Conn, act *activity, limits ...*bucket) int64 {
+	var r io.Reader = idleReader{src, act}
+	if len(limits) > 0 {
+		r = shapedReader{r, limits}
+	}
+	n, err := io.Copy(dst, r)
+	if err == nil {
+		if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+			return n
+		}
+	}
+	src.Close()
+	dst.Close()
+	return n
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/check"
+	"github.com/Chinsusu/proxy-server-local/pkg/logging"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshSessions keeps one multiplexed SSH connection per "ssh" upstream;
+// every client connection is a direct-tcpip channel on it. Sessions are
+// probed with keepalives and closed once unused for sshIdleClose.
+var sshSessions = &sshPool{m: map[string]*sshSession{}}
+
+const (
+	sshKeepAlive = 30 * time.Second
+	sshIdleClose = 10 * time.Minute
+)
+
+type sshPool struct {
+	mu sync.Mutex
+	m  map[string]*sshSession
+}
+
+type sshSession struct {
+	key    string
+	client *ssh.Client
+	chans  atomic.Int64 // open channels
+	used   atomic.Int64 // unix nanos of the last channel open or close
+}
+
+// sshKey identifies a session: credentials, host key and the hops in front
+// all have to match for a channel to reuse it.
+func sshKey(up *upstream) string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%v", up, up.User, up.Pass, up.SSH)
+}
+
+// dialViaSSH opens a direct-tcpip channel to dstHP on up's session. A
+// channel failing on a dead session redials the session once.
+func dialViaSSH(up *upstream, dstHP string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		s, err := sshSessions.get(up)
+		if err != nil {
+			return nil, fmt.Errorf("ssh to %s: %w", up.addr(), err)
+		}
+		c, err := s.client.Dial("tcp", dstHP)
+		if err == nil {
+			s.chans.Add(1)
+			s.used.Store(time.Now().UnixNano())
+			return &sshChan{Conn: c, s: s}, nil
+		}
+		// the server refusing this destination says nothing about the session
+		var oce *ssh.OpenChannelError
+		if errors.As(err, &oce) || attempt > 0 {
+			return nil, fmt.Errorf("ssh direct-tcpip %s: %w", dstHP, err)
+		}
+		sshSessions.drop(s, err)
+	}
+}
+
+// get returns the live session for up, dialing it (through up.Chain, if
+// any) when there is none.
+func (p *sshPool) get(up *upstream) (*sshSession, error) {
+	k := sshKey(up)
+	p.mu.Lock()
+	s := p.m[k]
+	p.mu.Unlock()
+	if s != nil {
+		return s, nil
+	}
+
+	cfg, err := check.SSHClientConfig(up.User, up.Pass, &up.SSH)
+	if err != nil {
+		return nil, err
+	}
+	var pc net.Conn
+	if len(up.Chain) > 0 {
+		pc, err = dialHops(up.Chain, up.addr(), nil) // shared by every client
+	} else {
+		pc, err = net.DialTimeout("tcp", up.addr(), 10*time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+	setKeepAlive(pc)
+	_ = pc.SetDeadline(time.Now().Add(10 * time.Second))
+	c, chans, reqs, err := ssh.NewClientConn(pc, up.addr(), cfg)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	_ = pc.SetDeadline(time.Time{})
+	s = &sshSession{key: k, client: ssh.NewClient(c, chans, reqs)}
+	s.used.Store(time.Now().UnixNano())
+
+	p.mu.Lock()
+	if old := p.m[k]; old != nil {
+		// lost a race with another connection's dial
+		p.mu.Unlock()
+		s.client.Close()
+		return old, nil
+	}
+	p.m[k] = s
+	p.mu.Unlock()
+	logging.Info.Printf("[fwd] ssh session to %s up", up)
+	go p.watch(s)
+	return s, nil
+}
+
+// watch probes s until it fails or has sat unused for sshIdleClose.
+func (p *sshPool) watch(s *sshSession) {
+	t := time.NewTicker(sshKeepAlive)
+	defer t.Stop()
+	for range t.C {
+		if s.chans.Load() == 0 && time.Since(time.Unix(0, s.used.Load())) > sshIdleClose {
+			p.drop(s, nil)
+			return
+		}
+		if _, _, err := s.client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			p.drop(s, err)
+			return
+		}
+	}
+}
+
+// drop forgets s and closes it; err is why, nil for an idle close.
+func (p *sshPool) drop(s *sshSession, err error) {
+	p.mu.Lock()
+	if p.m[s.key] == s {
+		delete(p.m, s.key)
+	}
+	p.mu.Unlock()
+	s.client.Close()
+	if err != nil {
+		logging.Warn.Printf("[fwd] ssh session to %s dropped: %v", s.client.RemoteAddr(), err)
+	}
+}
+
+// sshChan is a direct-tcpip channel counted against its session.
+type sshChan struct {
+	net.Conn
+	s    *sshSession
+	once sync.Once
+}
+
+func (c *sshChan) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *sshChan) Close() error {
+	c.once.Do(func() {
+		c.s.chans.Add(-1)
+		c.s.used.Store(time.Now().UnixNano())
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/check"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// tlsConfigs caches the client config per proxy so a custom CA is only
+// parsed once.
+var tlsConfigs sync.Map // tlsKey → *tls.Config
+
+type tlsKey struct {
+	host string
+	tls  types.ProxyTLS
+}
+
+// proxyTLS wraps pc in a TLS session to an "https" upstream proxy. pc is
+// closed on failure.
+func proxyTLS(pc net.Conn, up *upstream) (net.Conn, error) {
+	k := tlsKey{up.Host, up.TLS}
+	v, ok := tlsConfigs.Load(k)
+	if !ok {
+		cfg, err := check.ProxyTLSConfig(up.Host, &up.TLS)
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+		v, _ = tlsConfigs.LoadOrStore(k, cfg)
+	}
+	tc := tls.Client(pc, v.(*tls.Config))
+	_ = tc.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tc.Handshake(); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	_ = tc.SetDeadline(time.Time{})
+	return tc, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/logging"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// maxPendingConns bounds the records kept while the API is unreachable;
+// beyond it the oldest are dropped.
+const maxPendingConns = 20000
+
+// traffic buffers finished connections until they are pushed to the API,
+// which aggregates them per client, proxy and day.
+var traffic = &trafficLog{}
+
+type trafficLog struct {
+	mu      sync.Mutex
+	pending []types.ConnRecord
+}
+
+func (t *trafficLog) record(r types.ConnRecord) {
+	t.mu.Lock()
+	t.pending = append(t.pending, r)
+	if over := len(t.pending) - maxPendingConns; over > 0 {
+		t.pending = t.pending[over:]
+	}
+	t.mu.Unlock()
+}
+
+func (t *trafficLog) take() []types.ConnRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := t.pending
+	t.pending = nil
+	return out
+}
+
+// requeue puts back records that failed to post ahead of newer ones.
+func (t *trafficLog) requeue(recs []types.ConnRecord) {
+	t.mu.Lock()
+	t.pending = append(recs, t.pending...)
+	if over := len(t.pending) - maxPendingConns; over > 0 {
+		t.pending = t.pending[over:]
+	}
+	t.mu.Unlock()
+}
+
+// flushTraffic pushes buffered connection records to the API every interval.
+func flushTraffic(apiBase string, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		reportTraffic(apiBase)
+	}
+}
+
+func reportTraffic(apiBase string) {
+	recs := traffic.take()
+	if len(recs) == 0 {
+		return
+	}
+	if err := apiPost(apiBase, "/v1/traffic", recs); err != nil {
+		logging.Warn.Printf("[fwd] report traffic (%d conns): %v", len(recs), err)
+		traffic.requeue(recs)
+	}
+}
+
+// flushNow reports pending traffic and policy hits right away (on exit).
+func flushNow(apiBase string) {
+	reportTraffic(apiBase)
+	reportPolicyHits(apiBase)
+}
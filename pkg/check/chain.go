@@ -0,0 +1,168 @@
+package check
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/proxyproto"
+	"github.com/Chinsusu/proxy-server-local/pkg/shadowsocks"
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+)
+
+// CheckChain checks p as reached through hops, in order: the exit IP is
+// fetched over a tunnel built hop by hop, so every link is exercised.
+func CheckChain(ctx context.Context, hops []types.Proxy, p types.Proxy) Result {
+	chain := append(append([]types.Proxy{}, hops...), p)
+	return checkViaDial(ctx, "pgw-chain-health/1.0", func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return DialChain(ctx, chain, addr)
+	})
+}
+
+// DialChain connects to chain[0] and tunnels through each proxy in turn, the
+// last one to addr. Proxies with proxy_protocol set get a header first; the
+// check has no LAN client, so it is the UNKNOWN / LOCAL form.
+func DialChain(ctx context.Context, chain []types.Proxy, addr string) (net.Conn, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("empty chain")
+	}
+	first := net.JoinHostPort(chain[0].Host, strconv.Itoa(chain[0].Port))
+	conn, err := (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, "tcp", first)
+	if err != nil {
+		return nil, err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	for i, p := range chain {
+		next := addr
+		if i+1 < len(chain) {
+			next = net.JoinHostPort(chain[i+1].Host, strconv.Itoa(chain[i+1].Port))
+		}
+		if p.ProxyProtocol != 0 {
+			if err = proxyproto.Write(conn, p.ProxyProtocol, nil, nil); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("hop %d (%s %s:%d): PROXY header: %w", i+1, p.Type, p.Host, p.Port, err)
+			}
+		}
+		if conn, err = Tunnel(conn, p, next); err != nil {
+			return nil, fmt.Errorf("hop %d (%s %s:%d): %w", i+1, p.Type, p.Host, p.Port, err)
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Tunnel speaks p's protocol over conn, already connected to p, to reach
+// addr ("host:port"). conn is closed on failure.
+func Tunnel(conn net.Conn, p types.Proxy, addr string) (net.Conn, error) {
+	var err error
+	switch p.Type {
+	case "http":
+		err = httpConnect(conn, addr, p.Username, p.Password, p.AuthScheme)
+	case "https":
+		cfg, cerr := ProxyTLSConfig(p.Host, p.TLS)
+		if cerr != nil {
+			conn.Close()
+			return nil, cerr
+		}
+		tc := tls.Client(conn, cfg)
+		if err = tc.Handshake(); err == nil {
+			err = httpConnect(tc, addr, p.Username, p.Password, p.AuthScheme)
+		}
+		conn = tc
+	case "socks5":
+		d := &socksDialer{username: p.Username, password: p.Password}
+		if err = d.socks5Handshake(conn); err == nil {
+			err = d.socks5Connect(conn, addr)
+		}
+	case "socks4":
+		userid := ""
+		if p.Username != nil {
+			userid = *p.Username
+		}
+		err = SOCKS4Connect(conn, addr, userid)
+	case "shadowsocks":
+		pass := ""
+		if p.Password != nil {
+			pass = *p.Password
+		}
+		return shadowsocks.Tunnel(conn, p.Cipher, pass, addr)
+	case "ssh":
+		var sc net.Conn
+		if sc, err = sshTunnel(conn, p, addr); err == nil {
+			return sc, nil
+		}
+	default:
+		err = errors.New("unsupported proxy type: " + p.Type)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// httpConnect sends CONNECT addr on conn and waits for a 2xx reply. A hop
+// cannot be redialed, so a 407 challenge only works on a kept-alive
+// connection.
+func httpConnect(conn net.Conn, addr string, user, pass *string, scheme string) error {
+	u, pw := "", ""
+	if user != nil && pass != nil {
+		u, pw = *user, *pass
+	}
+	_, err := ProxyConnect(conn, addr, u, pw, scheme, nil)
+	return err
+}
+
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return o.r.Read(p)
+}
+
+// checkViaDial fetches the exit IP with every connection opened by dial.
+func checkViaDial(ctx context.Context, ua string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) Result {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:     dial,
+			TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	var lastErr error
+	for _, ep := range endpoints {
+		start := time.Now()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ep, nil)
+		req.Header.Set("User-Agent", ua)
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			lastErr = errors.New("non-200: " + resp.Status)
+			continue
+		}
+		elapsed := time.Since(start)
+		return Result{
+			Status:    classifyLatency(elapsed),
+			LatencyMs: int(elapsed.Milliseconds()),
+			ExitIP:    strings.TrimSpace(string(b)),
+		}
+	}
+	return Result{Status: types.StatusDown, Err: lastErr}
+}
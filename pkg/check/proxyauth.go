@@ -0,0 +1,253 @@
+package check
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ProxyConnect sends CONNECT addr over conn, already connected (and for
+// "https", TLS-wrapped) to an HTTP proxy, and waits for a 2xx reply.
+// scheme is the proxy's auth_scheme: "basic" sends the credentials up
+// front; otherwise none go until the proxy answers 407, and then only in
+// the scheme it asks for (Digest preferred, Basic unless scheme is
+// "digest"), so a password never travels in clear to a Digest proxy. The
+// answer goes on the same connection when the proxy keeps it open or else
+// on one from redial (nil: fail instead). It returns the connection the
+// tunnel is on; conn is closed on failure.
+func ProxyConnect(conn net.Conn, addr, user, pass, scheme string, redial func() (net.Conn, error)) (net.Conn, error) {
+	creds := user != "" || pass != ""
+	auth := ""
+	if creds && scheme == "basic" {
+		auth = basicAuth(user, pass)
+	}
+	resp, err := sendConnect(conn, addr, auth)
+	if err == nil && resp.StatusCode == http.StatusProxyAuthRequired && creds && auth == "" {
+		if auth, err = answerChallenge(resp.Header.Values("Proxy-Authenticate"), user, pass, scheme, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if !drained(resp) {
+			conn.Close()
+			if redial == nil {
+				return nil, errors.New("proxy closed the connection after its auth challenge")
+			}
+			if conn, err = redial(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err = sendConnect(conn, addr, auth)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		conn.Close()
+		return nil, errors.New("proxy refused CONNECT: " + resp.Status)
+	}
+	return conn, nil
+}
+
+// answerChallenge returns the Proxy-Authorization answering the 407's
+// Proxy-Authenticate values for CONNECT addr.
+func answerChallenge(values []string, user, pass, scheme, addr string) (string, error) {
+	if ch, ok := digestChallenge(values); ok {
+		return ch.authorize(user, pass, http.MethodConnect, addr)
+	}
+	if scheme != "digest" {
+		for _, v := range values {
+			if len(authParams(v, "Basic")) > 0 {
+				return basicAuth(user, pass), nil
+			}
+		}
+	}
+	return "", errors.New("proxy asks for no supported auth scheme: " + strings.Join(values, "; "))
+}
+
+func basicAuth(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func sendConnect(conn net.Conn, addr, auth string) (*http.Response, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if auth != "" {
+		req += "Proxy-Authorization: " + auth + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		return nil, err
+	}
+	// read byte-wise so nothing past the reply is buffered
+	return http.ReadResponse(bufio.NewReaderSize(oneByteReader{conn}, 16), &http.Request{Method: http.MethodConnect})
+}
+
+// drained reads off the body of a non-2xx reply so the connection can
+// carry another request; false means it cannot.
+func drained(resp *http.Response) bool {
+	if resp.Close || (resp.ContentLength < 0 && len(resp.TransferEncoding) == 0) || resp.ContentLength > 64<<10 {
+		return false
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10+1))
+	return err == nil && n <= 64<<10
+}
+
+// challenge is a parsed Digest challenge (RFC 7616).
+type challenge struct {
+	realm, nonce, opaque, algorithm string
+	qop, qopAuth                    bool // qop offered / "auth" among it
+}
+
+// digestChallenge picks the Digest challenge to answer among the
+// Proxy-Authenticate values, preferring SHA-256 over MD5.
+func digestChallenge(values []string) (challenge, bool) {
+	var best challenge
+	found := false
+	for _, v := range values {
+		for _, params := range digestParams(v) {
+			ch := challenge{
+				realm:     params["realm"],
+				nonce:     params["nonce"],
+				opaque:    params["opaque"],
+				algorithm: strings.ToUpper(params["algorithm"]),
+			}
+			if ch.algorithm == "" {
+				ch.algorithm = "MD5"
+			}
+			if q, ok := params["qop"]; ok {
+				ch.qop = true
+				for _, o := range strings.Split(q, ",") {
+					ch.qopAuth = ch.qopAuth || strings.TrimSpace(strings.ToLower(o)) == "auth"
+				}
+			}
+			if ch.hash() == nil || ch.nonce == "" || (ch.qop && !ch.qopAuth) {
+				continue
+			}
+			if !found || strings.HasPrefix(ch.algorithm, "SHA-256") {
+				best, found = ch, true
+			}
+		}
+	}
+	return best, found
+}
+
+// digestParams returns the parameters of each Digest challenge in a header
+// value, which may also hold challenges of other schemes.
+func digestParams(v string) []map[string]string { return authParams(v, "Digest") }
+
+// authParams returns the parameters of each challenge of the given scheme
+// in a Proxy-Authenticate value.
+func authParams(v, scheme string) []map[string]string {
+	var out []map[string]string
+	var cur map[string]string
+	for s := v; ; {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return out
+		}
+		i := strings.IndexAny(s, "= \t,")
+		if i < 0 || s[i] != '=' {
+			// a scheme name starts the next challenge
+			tok := s
+			if i >= 0 {
+				tok, s = s[:i], s[i:]
+			} else {
+				s = ""
+			}
+			cur = nil
+			if strings.EqualFold(tok, scheme) {
+				cur = map[string]string{}
+				out = append(out, cur)
+			}
+			continue
+		}
+		key := strings.ToLower(s[:i])
+		s = s[i+1:]
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			j := 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			val, s = b.String(), s[min(j+1, len(s)):]
+		} else {
+			j := strings.IndexAny(s, " \t,")
+			if j < 0 {
+				j = len(s)
+			}
+			val, s = s[:j], s[j:]
+		}
+		if cur != nil {
+			cur[key] = val
+		}
+	}
+}
+
+func (ch challenge) hash() func() hash.Hash {
+	switch strings.TrimSuffix(ch.algorithm, "-SESS") {
+	case "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// newCnonce returns the client nonce of a Digest answer; tests replace it.
+var newCnonce = func() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authorize returns the Proxy-Authorization value answering ch.
+func (ch challenge) authorize(user, pass, method, uri string) (string, error) {
+	newHash := ch.hash()
+	if newHash == nil {
+		return "", errors.New("unsupported digest algorithm: " + ch.algorithm)
+	}
+	h := func(s string) string {
+		d := newHash()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	cnonce, err := newCnonce()
+	if err != nil {
+		return "", err
+	}
+	ha1 := h(user + ":" + ch.realm + ":" + pass)
+	if strings.HasSuffix(ch.algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + ch.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	var resp string
+	if ch.qop {
+		resp = h(ha1 + ":" + ch.nonce + ":00000001:" + cnonce + ":auth:" + ha2)
+	} else {
+		resp = h(ha1 + ":" + ch.nonce + ":" + ha2)
+	}
+	q := func(s string) string { return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"` }
+	out := "Digest username=" + q(user) + ", realm=" + q(ch.realm) + ", nonce=" + q(ch.nonce) +
+		", uri=" + q(uri) + ", algorithm=" + ch.algorithm + ", response=" + q(resp)
+	if ch.qop {
+		out += ", qop=auth, nc=00000001, cnonce=" + q(cnonce)
+	}
+	if ch.opaque != "" {
+		out += ", opaque=" + q(ch.opaque)
+	}
+	return out, nil
+}
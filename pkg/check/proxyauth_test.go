@@ -0,0 +1,223 @@
+package check
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestParams(t *testing.T) {
+	got := digestParams(`Basic realm="basic", Digest Realm="a, b", nonce="n\"q", qop="auth,auth-int", ` +
+		`Newauth realm="other", Digest algorithm=SHA-256,nonce=xyz`)
+	want := []map[string]string{
+		{"realm": "a, b", "nonce": `n"q`, "qop": "auth,auth-int"},
+		{"algorithm": "SHA-256", "nonce": "xyz"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := digestParams(`Basic realm="only basic"`); len(got) != 0 {
+		t.Fatalf("Basic only: got %v", got)
+	}
+}
+
+func TestDigestChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		ok     bool
+		alg    string
+		nonce  string
+		qop    bool
+	}{
+		{"md5 default", []string{`Digest realm="p", nonce="n1"`}, true, "MD5", "n1", false},
+		{"qop auth", []string{`Digest realm="p", nonce="n1", qop="auth-int, auth"`}, true, "MD5", "n1", true},
+		{"mixed Basic, Digest", []string{`Basic realm="p", Digest realm="p", nonce="n1", qop="auth"`}, true, "MD5", "n1", true},
+		{"prefers SHA-256", []string{
+			`Basic realm="p"`,
+			`Digest realm="p", nonce="md5", algorithm=MD5, qop="auth"`,
+			`Digest realm="p", nonce="sha", algorithm=SHA-256, qop="auth"`,
+		}, true, "SHA-256", "sha", true},
+		{"sess", []string{`Digest realm="p", nonce="n1", algorithm=md5-sess, qop="auth"`}, true, "MD5-SESS", "n1", true},
+		{"skips unsupported", []string{
+			`Digest realm="p", nonce="x", algorithm=SHA-512-256`,
+			`Digest realm="p", nonce="n1", algorithm=MD5`,
+		}, true, "MD5", "n1", false},
+		{"auth-int only", []string{`Digest realm="p", nonce="n1", qop="auth-int"`}, false, "", "", false},
+		{"no nonce", []string{`Digest realm="p"`}, false, "", "", false},
+		{"basic only", []string{`Basic realm="p"`}, false, "", "", false},
+	}
+	for _, tt := range tests {
+		ch, ok := digestChallenge(tt.values)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v", tt.name, ok)
+			continue
+		}
+		if ok && (ch.algorithm != tt.alg || ch.nonce != tt.nonce || ch.qop != tt.qop) {
+			t.Errorf("%s: got %+v", tt.name, ch)
+		}
+	}
+}
+
+// The examples of RFC 7616 section 3.9.1 (user Mufasa); the answers without
+// qop and for the -sess variants were computed independently with Python's
+// hashlib.
+func TestAuthorize(t *testing.T) {
+	defer func(f func() (string, error)) { newCnonce = f }(newCnonce)
+	newCnonce = func() (string, error) { return "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", nil }
+
+	base := challenge{
+		realm:  "http-auth@example.org",
+		nonce:  "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		opaque: "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+	}
+	tests := []struct {
+		algorithm string
+		qop       bool
+		want      string
+	}{
+		{"MD5", true, "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", true, "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+		{"MD5", false, "7b2cc3b30e75b4777ea31027084363fd"},
+		{"SHA-256", false, "a1306b0595a6c7fe96c448631fb5cfbd5107bd1fe1da729d978dd7446b812363"},
+		{"MD5-SESS", true, "e783283f46242139c486a698fec7211d"},
+		{"SHA-256-SESS", true, "2fd51b3a77ad75bad6afad6003e818d767133c46d9e2749e7f5232ae1ea3efd7"},
+	}
+	for _, tt := range tests {
+		ch := base
+		ch.algorithm, ch.qop, ch.qopAuth = tt.algorithm, tt.qop, tt.qop
+		out, err := ch.authorize("Mufasa", "Circle of Life", "GET", "/dir/index.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := tt.algorithm
+		if !tt.qop {
+			name += " without qop"
+		}
+		if !strings.HasPrefix(out, "Digest ") {
+			t.Errorf("%s: %s", name, out)
+			continue
+		}
+		p := digestParams(out)[0]
+		if p["response"] != tt.want {
+			t.Errorf("%s: response = %s, want %s", name, p["response"], tt.want)
+		}
+		if p["username"] != "Mufasa" || p["uri"] != "/dir/index.html" || p["algorithm"] != tt.algorithm || p["opaque"] != base.opaque {
+			t.Errorf("%s: %s", name, out)
+		}
+		if _, has := p["cnonce"]; has != tt.qop || (tt.qop && (p["qop"] != "auth" || p["nc"] != "00000001")) {
+			t.Errorf("%s: qop fields: %s", name, out)
+		}
+	}
+
+	ch := challenge{realm: "p", nonce: "n", algorithm: "SHA-512"}
+	if _, err := ch.authorize("u", "p", "CONNECT", "example.com:443"); err == nil {
+		t.Error("unsupported algorithm accepted")
+	}
+}
+
+// fakeProxy answers CONNECTs on ln: without credentials it replies 407 with
+// the given challenges (closing the connection if closeAfter407), and it
+// accepts any Proxy-Authorization of an offered scheme. It reports the
+// Proxy-Authorization of every request it got.
+func fakeProxy(ln net.Listener, challenges []string, closeAfter407 bool) <-chan string {
+	seen := make(chan string, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					auth := req.Header.Get("Proxy-Authorization")
+					seen <- auth
+					ok := false
+					for _, c := range challenges {
+						scheme, _, _ := strings.Cut(c, " ")
+						ok = ok || (auth != "" && strings.HasPrefix(auth, scheme+" "))
+					}
+					if ok {
+						io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+						return
+					}
+					resp := "HTTP/1.1 407 Proxy Authentication Required\r\n"
+					for _, c := range challenges {
+						resp += "Proxy-Authenticate: " + c + "\r\n"
+					}
+					if closeAfter407 {
+						io.WriteString(conn, resp+"Connection: close\r\n\r\n")
+						return
+					}
+					io.WriteString(conn, resp+"Content-Length: 0\r\n\r\n")
+				}
+			}()
+		}
+	}()
+	return seen
+}
+
+func TestProxyConnect(t *testing.T) {
+	digest := `Digest realm="p", nonce="n1", qop="auth"`
+	basic := `Basic realm="p"`
+	tests := []struct {
+		name       string
+		challenges []string
+		scheme     string
+		close      bool
+		want       []string // schemes of the Proxy-Authorization sent, "" for none
+		ok         bool
+	}{
+		{"digest", []string{digest}, "", false, []string{"", "Digest"}, true},
+		{"digest preferred", []string{basic, digest}, "", false, []string{"", "Digest"}, true},
+		{"basic on request", []string{basic}, "", false, []string{"", "Basic"}, true},
+		{"basic up front", []string{basic}, "basic", false, []string{"Basic"}, true},
+		{"digest only", []string{basic}, "digest", false, []string{""}, false},
+		{"redial after close", []string{digest}, "", true, []string{"", "Digest"}, true},
+	}
+	for _, tt := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := fakeProxy(ln, tt.challenges, tt.close)
+		dial := func() (net.Conn, error) { return net.Dial("tcp", ln.Addr().String()) }
+		conn, _ := dial()
+		conn, err = ProxyConnect(conn, "example.com:443", "u", "secret", tt.scheme, dial)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		for i, w := range tt.want {
+			var got string
+			select {
+			case got = <-seen:
+			case <-time.After(time.Second):
+				t.Errorf("%s: request %d not sent", tt.name, i+1)
+				continue
+			}
+			if scheme, _, _ := strings.Cut(got, " "); scheme != w {
+				t.Errorf("%s: request %d sent %q, want scheme %q", tt.name, i+1, got, w)
+			}
+		}
+		select {
+		case got := <-seen:
+			t.Errorf("%s: extra request with %q", tt.name, got)
+		default:
+		}
+		ln.Close()
+	}
+}
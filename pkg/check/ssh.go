@@ -0,0 +1,102 @@
+package check
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Chinsusu/proxy-server-local/pkg/types"
+	"golang.org/x/crypto/ssh"
+)
+
+// CheckSSH checks an "ssh" upstream by fetching the exit IP over a
+// direct-tcpip channel, the way pgw-fwd uses it.
+func CheckSSH(ctx context.Context, p types.Proxy) Result {
+	return CheckChain(ctx, nil, p)
+}
+
+// SSHClientConfig builds the client config for an "ssh" proxy.
+func SSHClientConfig(user, pass string, s *types.ProxySSH) (*ssh.ClientConfig, error) {
+	if user == "" {
+		return nil, errors.New("ssh proxy requires username")
+	}
+	if s == nil {
+		s = &types.ProxySSH{}
+	}
+	cfg := &ssh.ClientConfig{User: user, Timeout: 10 * time.Second}
+	if s.PrivateKey != "" {
+		var signer ssh.Signer
+		var err error
+		if s.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(s.PrivateKey), []byte(s.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(s.PrivateKey))
+		}
+		if err != nil {
+			return nil, errors.New("ssh.private_key: " + err.Error())
+		}
+		cfg.Auth = append(cfg.Auth, ssh.PublicKeys(signer))
+	}
+	if pass != "" {
+		cfg.Auth = append(cfg.Auth, ssh.Password(pass))
+	}
+	if len(cfg.Auth) == 0 {
+		return nil, errors.New("ssh proxy requires password or ssh.private_key")
+	}
+	switch {
+	case s.HostKey != "":
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.HostKey))
+		if err != nil {
+			return nil, errors.New("ssh.host_key: " + err.Error())
+		}
+		cfg.HostKeyCallback = ssh.FixedHostKey(key)
+	case s.InsecureIgnoreHostKey:
+		cfg.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, errors.New("ssh proxy requires ssh.host_key (or ssh.insecure_ignore_host_key)")
+	}
+	return cfg, nil
+}
+
+// sshTunnel opens an SSH session to p over conn and a direct-tcpip channel
+// to addr on it; closing the returned conn ends the session too.
+func sshTunnel(conn net.Conn, p types.Proxy, addr string) (net.Conn, error) {
+	user, pass := "", ""
+	if p.Username != nil {
+		user = *p.Username
+	}
+	if p.Password != nil {
+		pass = *p.Password
+	}
+	cfg, err := SSHClientConfig(user, pass, p.SSH)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, net.JoinHostPort(p.Host, strconv.Itoa(p.Port)), cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	ch, err := client.Dial("tcp", addr)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &sessionConn{Conn: ch, client: client}, nil
+}
+
+// sessionConn is a channel that owns its SSH session.
+type sessionConn struct {
+	net.Conn
+	client *ssh.Client
+	once   sync.Once
+}
+
+func (c *sessionConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.client.Close() })
+	return err
+}
@@ -15,7 +15,9 @@ type API struct { Addr, JWTSecret string }
 type UI struct { Addr, JWTSecret string }
 type Health struct { Interval time.Duration }
 type Agent struct { Addr, WANIF, LANIF string }
-type Fwd struct { Addr string }
+// Fwd.Mode: "unit" (one pgw-fwd@<port> per client, started by the API) or
+// "multi" (a single pgw-fwd serving the whole port range by itself).
+type Fwd struct { Addr, Mode string }
 
 func LoadAPI() API {
 	return API{ Addr: getenv("PGW_API_ADDR", ":8080"), JWTSecret: getenv("PGW_JWT_SECRET", "dev-change-me") }
@@ -29,4 +31,4 @@ func LoadHealth() Health {
 func LoadAgent() Agent {
 	return Agent{ Addr: getenv("PGW_AGENT_ADDR", ":9090"), WANIF: getenv("PGW_WAN_IFACE","eth0"), LANIF: getenv("PGW_LAN_IFACE","ens19") }
 }
-func LoadFwd() Fwd { return Fwd{ Addr: getenv("PGW_FWD_ADDR", ":15000") } }
+func LoadFwd() Fwd { return Fwd{ Addr: getenv("PGW_FWD_ADDR", ":15000"), Mode: getenv("PGW_FWD_MODE", "unit") } }
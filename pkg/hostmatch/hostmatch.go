@@ -0,0 +1,83 @@
+// Package hostmatch matches destination host names (TLS SNI or HTTP Host)
+// against operator-supplied patterns.
+package hostmatch
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Kinds of pattern accepted by Compile.
+const (
+	Exact    = "exact"    // "api.example.com"
+	Suffix   = "suffix"   // "example.com" matches example.com and any subdomain
+	Wildcard = "wildcard" // "*.example.com", "cdn-?.example.*"
+	Regex    = "regex"    // Go RE2 syntax, unanchored unless the pattern anchors itself
+)
+
+type Matcher struct {
+	kind    string
+	pattern string
+	re      *regexp.Regexp
+}
+
+// Compile validates pattern for kind and returns a reusable matcher.
+// Matching is case-insensitive and ignores a trailing dot.
+func Compile(kind, pattern string) (*Matcher, error) {
+	p := normalize(pattern)
+	if p == "" {
+		return nil, errors.New("empty pattern")
+	}
+	m := &Matcher{kind: kind, pattern: p}
+	switch kind {
+	case Exact:
+	case Suffix:
+		m.pattern = strings.TrimPrefix(p, ".")
+	case Wildcard:
+		var b strings.Builder
+		b.WriteString("^")
+		for _, r := range p {
+			switch r {
+			case '*':
+				b.WriteString(".*")
+			case '?':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		b.WriteString("$")
+		m.re = regexp.MustCompile(b.String())
+	case Regex:
+		re, err := regexp.Compile("(?i)" + strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("bad regex: %w", err)
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("unsupported match kind: %s (supported: exact, suffix, wildcard, regex)", kind)
+	}
+	return m, nil
+}
+
+// Match reports whether host satisfies the pattern.
+func (m *Matcher) Match(host string) bool {
+	h := normalize(host)
+	if h == "" {
+		return false
+	}
+	switch m.kind {
+	case Exact:
+		return h == m.pattern
+	case Suffix:
+		return h == m.pattern || strings.HasSuffix(h, "."+m.pattern)
+	default:
+		return m.re.MatchString(h)
+	}
+}
+
+func normalize(s string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+}
@@ -0,0 +1,66 @@
+// Package proxyproto writes HAProxy PROXY protocol headers (v1 text, v2
+// binary), which tell an upstream the real client and destination of a
+// connection relayed to it.
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+var sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Header returns the version 1 or 2 header for a connection from src to
+// dst. With no src or dst (a connection the gateway makes on its own, such
+// as a health check) it is "PROXY UNKNOWN" / the v2 LOCAL command; so are
+// mixed address families.
+func Header(version int, src, dst *net.TCPAddr) ([]byte, error) {
+	var s, d net.IP
+	if src != nil && dst != nil {
+		if s4, d4 := src.IP.To4(), dst.IP.To4(); s4 != nil && d4 != nil {
+			s, d = s4, d4
+		} else if s4 == nil && d4 == nil && src.IP.To16() != nil && dst.IP.To16() != nil {
+			s, d = src.IP.To16(), dst.IP.To16()
+		}
+	}
+	switch version {
+	case 1:
+		if s == nil {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		fam := "TCP4"
+		if len(s) == net.IPv6len {
+			fam = "TCP6"
+		}
+		return []byte("PROXY " + fam + " " + s.String() + " " + d.String() + " " +
+			strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n"), nil
+	case 2:
+		b := append([]byte{}, sigV2...)
+		if s == nil {
+			return append(b, 0x20, 0x00, 0, 0), nil // LOCAL, UNSPEC
+		}
+		fam := byte(0x11) // TCP over IPv4
+		if len(s) == net.IPv6len {
+			fam = 0x21 // TCP over IPv6
+		}
+		b = append(b, 0x21, fam)
+		b = binary.BigEndian.AppendUint16(b, uint16(2*len(s)+4))
+		b = append(append(b, s...), d...)
+		b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+		return binary.BigEndian.AppendUint16(b, uint16(dst.Port)), nil
+	}
+	return nil, errors.New("unsupported PROXY protocol version: " + strconv.Itoa(version))
+}
+
+// Write sends the header for src -> dst on w.
+func Write(w io.Writer, version int, src, dst *net.TCPAddr) error {
+	h, err := Header(version, src, dst)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(h)
+	return err
+}
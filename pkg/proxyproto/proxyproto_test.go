@@ -0,0 +1,63 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func addr(s string, port int) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(s), Port: port}
+}
+
+func TestHeader(t *testing.T) {
+	sig := "\r\n\r\n\x00\r\nQUIT\n"
+	v6src := "\x20\x01\x0d\xb8" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+	v6dst := "\x20\x01\x0d\xb8" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"
+	tests := []struct {
+		name     string
+		version  int
+		src, dst *net.TCPAddr
+		want     string
+	}{
+		{"v1 tcp4", 1, addr("192.168.2.3", 51000), addr("93.184.216.34", 443),
+			"PROXY TCP4 192.168.2.3 93.184.216.34 51000 443\r\n"},
+		{"v1 tcp4 from mapped", 1, addr("::ffff:192.168.2.3", 51000), addr("93.184.216.34", 443),
+			"PROXY TCP4 192.168.2.3 93.184.216.34 51000 443\r\n"},
+		{"v1 tcp6", 1, addr("2001:db8::1", 51000), addr("2001:db8::2", 443),
+			"PROXY TCP6 2001:db8::1 2001:db8::2 51000 443\r\n"},
+		{"v1 mixed families", 1, addr("192.168.2.3", 51000), addr("2001:db8::2", 443),
+			"PROXY UNKNOWN\r\n"},
+		{"v1 local", 1, nil, nil, "PROXY UNKNOWN\r\n"},
+		{"v2 ipv4", 2, addr("192.168.2.3", 51000), addr("93.184.216.34", 443),
+			sig + "\x21\x11\x00\x0c" + "\xc0\xa8\x02\x03" + "\x5d\xb8\xd8\x22" + "\xc7\x38" + "\x01\xbb"},
+		{"v2 ipv6", 2, addr("2001:db8::1", 51000), addr("2001:db8::2", 443),
+			sig + "\x21\x21\x00\x24" + v6src + v6dst + "\xc7\x38" + "\x01\xbb"},
+		{"v2 mixed families", 2, addr("2001:db8::1", 51000), addr("93.184.216.34", 443),
+			sig + "\x20\x00\x00\x00"},
+		{"v2 local", 2, nil, nil, sig + "\x20\x00\x00\x00"},
+		{"v2 no dst", 2, addr("192.168.2.3", 51000), nil, sig + "\x20\x00\x00\x00"},
+	}
+	for _, tt := range tests {
+		got, err := Header(tt.version, tt.src, tt.dst)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, []byte(tt.want)) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHeaderUnsupportedVersion(t *testing.T) {
+	for _, v := range []int{0, 3} {
+		if h, err := Header(v, addr("192.168.2.3", 1), addr("192.168.2.4", 2)); err == nil {
+			t.Errorf("version %d: got %q, want an error", v, h)
+		}
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, 3, nil, nil); err == nil || buf.Len() != 0 {
+		t.Errorf("Write version 3: %v, wrote %d bytes", err, buf.Len())
+	}
+}
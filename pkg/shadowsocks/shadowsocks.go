@@ -0,0 +1,283 @@
+// Package shadowsocks implements the client side of the Shadowsocks AEAD
+// stream protocol: each direction starts with a random salt, followed by
+// chunks of [sealed 2-byte length][sealed payload], and the first payload
+// the client sends is the target address in SOCKS5 form.
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const maxPayload = 0x3FFF
+
+type method struct {
+	keySize int
+	aead    func(key []byte) (cipher.AEAD, error)
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+var methods = map[string]method{
+	"chacha20-ietf-poly1305": {32, chacha20poly1305.New},
+	"aes-256-gcm":            {32, aesGCM},
+	"aes-192-gcm":            {24, aesGCM},
+	"aes-128-gcm":            {16, aesGCM},
+}
+
+// Methods lists the supported cipher names.
+func Methods() []string {
+	var out []string
+	for m := range methods {
+		out = append(out, m)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Cipher is an AEAD method with the master key derived from a password.
+type Cipher struct {
+	m   method
+	key []byte
+}
+
+// New returns the cipher for method (case-insensitive) and password.
+func New(name, password string) (*Cipher, error) {
+	m, ok := methods[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.New("unsupported shadowsocks cipher: " + name + " (supported: " + strings.Join(Methods(), ", ") + ")")
+	}
+	if password == "" {
+		return nil, errors.New("shadowsocks password is required")
+	}
+	return &Cipher{m: m, key: kdf(password, m.keySize)}, nil
+}
+
+// kdf is OpenSSL's EVP_BytesToKey with MD5 and no salt, as Shadowsocks uses.
+func kdf(password string, n int) []byte {
+	var key, prev []byte
+	for len(key) < n {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:n]
+}
+
+// subkey is the per-session key: HKDF-SHA1 of the master key and salt.
+func (c *Cipher) subkey(salt []byte) ([]byte, error) {
+	sub := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (c *Cipher) session(salt []byte) (cipher.AEAD, error) {
+	sub, err := c.subkey(salt)
+	if err != nil {
+		return nil, err
+	}
+	return c.m.aead(sub)
+}
+
+// Tunnel wraps conn, already connected to a Shadowsocks server, and sends
+// the request for addr ("host:port"). conn is closed on failure.
+func Tunnel(conn net.Conn, name, password, addr string) (net.Conn, error) {
+	c, err := New(name, password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	hdr, err := socksAddr(addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sc := &Conn{Conn: conn, c: c, pending: -1}
+	if _, err := sc.Write(hdr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// socksAddr encodes addr as ATYP, address, port.
+func socksAddr(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, errors.New("bad port: " + portStr)
+	}
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, errors.New("domain name too long")
+		}
+		b = append([]byte{0x03, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{0x01}, ip4...)
+	} else {
+		b = append([]byte{0x04}, ip...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// Conn is the client end of a Shadowsocks AEAD stream. Reads keep partial
+// chunks across calls, so a read deadline firing mid-chunk loses nothing.
+type Conn struct {
+	net.Conn
+	c *Cipher
+
+	enc      cipher.AEAD
+	encNonce []byte
+
+	dec      cipher.AEAD
+	decNonce []byte
+	raw      []byte // ciphertext read but not yet decrypted
+	plain    []byte // decrypted payload not yet returned
+	pending  int    // payload length of the chunk being read; -1 = none
+	tmp      [4096]byte
+}
+
+// NetConn returns the underlying connection.
+func (sc *Conn) NetConn() net.Conn { return sc.Conn }
+
+func (sc *Conn) Write(p []byte) (int, error) {
+	var out []byte
+	if sc.enc == nil {
+		salt := make([]byte, len(sc.c.key))
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		aead, err := sc.c.session(salt)
+		if err != nil {
+			return 0, err
+		}
+		sc.enc, sc.encNonce = aead, make([]byte, aead.NonceSize())
+		out = salt
+	}
+	for rest := p; len(rest) > 0; {
+		n := len(rest)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		out = sc.enc.Seal(out, sc.encNonce, []byte{byte(n >> 8), byte(n)}, nil)
+		increment(sc.encNonce)
+		out = sc.enc.Seal(out, sc.encNonce, rest[:n], nil)
+		increment(sc.encNonce)
+		rest = rest[n:]
+	}
+	if _, err := sc.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (sc *Conn) Read(p []byte) (int, error) {
+	for len(sc.plain) == 0 {
+		if err := sc.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, sc.plain)
+	sc.plain = sc.plain[n:]
+	return n, nil
+}
+
+// readChunk decrypts the next chunk into sc.plain.
+func (sc *Conn) readChunk() error {
+	if sc.dec == nil {
+		saltSize := len(sc.c.key)
+		if err := sc.fill(saltSize); err != nil {
+			return err
+		}
+		aead, err := sc.c.session(sc.raw[:saltSize])
+		if err != nil {
+			return err
+		}
+		sc.dec, sc.decNonce = aead, make([]byte, aead.NonceSize())
+		sc.raw = sc.raw[saltSize:]
+	}
+	tag := sc.dec.Overhead()
+	if sc.pending < 0 {
+		if err := sc.fill(2 + tag); err != nil {
+			return err
+		}
+		l, err := sc.dec.Open(nil, sc.decNonce, sc.raw[:2+tag], nil)
+		if err != nil {
+			return errors.New("shadowsocks: bad chunk length (wrong password or cipher?)")
+		}
+		increment(sc.decNonce)
+		sc.raw = sc.raw[2+tag:]
+		sc.pending = (int(l[0])<<8 | int(l[1])) & maxPayload
+	}
+	if err := sc.fill(sc.pending + tag); err != nil {
+		return err
+	}
+	payload, err := sc.dec.Open(nil, sc.decNonce, sc.raw[:sc.pending+tag], nil)
+	if err != nil {
+		return errors.New("shadowsocks: bad chunk payload")
+	}
+	increment(sc.decNonce)
+	sc.raw = sc.raw[sc.pending+tag:]
+	sc.pending = -1
+	sc.plain = payload
+	return nil
+}
+
+// fill reads until sc.raw holds at least n bytes. EOF between chunks is a
+// clean end of stream, anywhere else it is unexpected.
+func (sc *Conn) fill(n int) error {
+	for len(sc.raw) < n {
+		m, err := sc.Conn.Read(sc.tmp[:])
+		sc.raw = append(sc.raw, sc.tmp[:m]...)
+		if err != nil {
+			if err == io.EOF && (len(sc.raw) > 0 || sc.pending >= 0) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// CloseWrite half-closes the underlying connection when it supports it.
+func (sc *Conn) CloseWrite() error {
+	if cw, ok := sc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Vectors from `openssl enc -aes-256-cbc -k foobar -nosalt -P -md md5`
+// (key followed by iv is EVP_BytesToKey's 48-byte output).
+const (
+	foobarKey = "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf"
+	foobarIV  = "0ebf5878e82af7da618ed56fc67d4ab7"
+)
+
+func TestKDF(t *testing.T) {
+	for _, n := range []int{16, 24, 32, 48} {
+		want := (foobarKey + foobarIV)[:2*n]
+		if got := hex.EncodeToString(kdf("foobar", n)); got != want {
+			t.Errorf("kdf(foobar, %d) = %s, want %s", n, got, want)
+		}
+	}
+}
+
+func TestSubkey(t *testing.T) {
+	// HKDF-SHA1(master key, salt 00 01 02 ..., "ss-subkey"), computed
+	// independently with Python's hmac module
+	tests := []struct {
+		method, want string
+	}{
+		{"aes-256-gcm", "c4f0e9818348b2f30188d82b37a4cddc9f5ea531070ec67225160209faff573c"},
+		{"aes-128-gcm", "e59e945699e8699144c332b9e641ef65"},
+	}
+	for _, tt := range tests {
+		c, err := New(tt.method, "foobar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		salt := make([]byte, len(c.key))
+		for i := range salt {
+			salt[i] = byte(i)
+		}
+		sub, err := c.subkey(salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(sub); got != tt.want {
+			t.Errorf("%s: subkey = %s, want %s", tt.method, got, tt.want)
+		}
+	}
+}
+
+// serve accepts one tunnel on ln like a Shadowsocks server would: it reads
+// the target address, answers with "ok <addr>" and echoes everything after.
+func serve(ln net.Listener, method, password string) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		c, err := New(method, password)
+		if err != nil {
+			done <- err
+			return
+		}
+		sc := &Conn{Conn: conn, c: c, pending: -1}
+		// ATYP 0x03, length, name, port
+		hdr := make([]byte, 2)
+		if _, err := io.ReadFull(sc, hdr); err != nil {
+			done <- err
+			return
+		}
+		rest := make([]byte, int(hdr[1])+2)
+		if _, err := io.ReadFull(sc, rest); err != nil {
+			done <- err
+			return
+		}
+		if _, err := sc.Write([]byte("ok " + string(rest[:hdr[1]]))); err != nil {
+			done <- err
+			return
+		}
+		_, err = io.Copy(sc, sc)
+		done <- err
+	}()
+	return done
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, method := range Methods() {
+		t.Run(method, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			done := serve(ln, method, "secret")
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc, err := Tunnel(conn, method, "secret", "example.com:443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sc.Close()
+
+			greet := make([]byte, len("ok example.com"))
+			if _, err := io.ReadFull(sc, greet); err != nil || string(greet) != "ok example.com" {
+				t.Fatalf("greeting %q, %v", greet, err)
+			}
+			// several chunks, the last one partial
+			msg := bytes.Repeat([]byte("0123456789abcdef"), 3*maxPayload/16+5)
+			go sc.Write(msg)
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(sc, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatal("echo differs from what was sent")
+			}
+			if err := sc.(*Conn).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if n, err := sc.Read(got); n != 0 || err != io.EOF {
+				t.Fatalf("after server close: %d, %v; want EOF", n, err)
+			}
+		})
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := serve(ln, "aes-256-gcm", "secret")
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := Tunnel(conn, "aes-256-gcm", "wrong", "example.com:443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err == nil {
+		t.Fatal("server accepted a stream sealed with the wrong password")
+	}
+}
+
+// recorder is a net.Conn that only keeps what is written to it.
+type recorder struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (r *recorder) Write(p []byte) (int, error) { return r.buf.Write(p) }
+
+func TestReadDeadlineMidChunk(t *testing.T) {
+	c, err := New("chacha20-ietf-poly1305", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what a server would send: salt, then two chunks
+	rec := &recorder{}
+	enc := &Conn{Conn: rec, c: c, pending: -1}
+	enc.Write([]byte("first chunk"))
+	enc.Write([]byte("second chunk"))
+	wire := rec.buf.Bytes()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	sc := &Conn{Conn: client, c: c, pending: -1}
+
+	// stop inside the second chunk's payload, after its length
+	cut := len(c.key) + (2 + 16) + (len("first chunk") + 16) + (2 + 16) + 4
+	go server.Write(wire[:cut])
+
+	buf := make([]byte, 64)
+	n, err := sc.Read(buf)
+	if err != nil || string(buf[:n]) != "first chunk" {
+		t.Fatalf("first read %q, %v", buf[:n], err)
+	}
+	sc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := sc.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read with partial chunk: %v, want deadline exceeded", err)
+	}
+
+	sc.SetReadDeadline(time.Time{})
+	go server.Write(wire[cut:])
+	n, err = sc.Read(buf)
+	if err != nil || string(buf[:n]) != "second chunk" {
+		t.Fatalf("read after deadline %q, %v", buf[:n], err)
+	}
+}
@@ -14,15 +14,18 @@ import (
 )
 
 type fileState struct {
-	Proxies  map[string]types.Proxy   `json:"proxies"`
-	Clients  map[string]types.Client  `json:"clients"`
-	Mappings map[string]types.Mapping `json:"mappings"`
+	Proxies  map[string]types.Proxy        `json:"proxies"`
+	Clients  map[string]types.Client       `json:"clients"`
+	Mappings map[string]types.Mapping      `json:"mappings"`
+	Policies map[string]types.DomainPolicy `json:"policies,omitempty"`
+	Traffic  map[string]types.TrafficStat  `json:"traffic,omitempty"`
 }
 
 type fileStore struct {
-	mu    sync.RWMutex
-	path  string
-	state fileState
+	mu     sync.RWMutex
+	path   string
+	state  fileState
+	recent []types.ConnRecord // connection log is not persisted
 }
 
 func NewFile(path string) Store {
@@ -33,6 +36,8 @@ func NewFile(path string) Store {
 			Proxies:  map[string]types.Proxy{},
 			Clients:  map[string]types.Client{},
 			Mappings: map[string]types.Mapping{},
+			Policies: map[string]types.DomainPolicy{},
+			Traffic:  map[string]types.TrafficStat{},
 		}
 		_ = fs.save()
 	}
@@ -47,6 +52,8 @@ func (s *fileStore) load() error {
 	if st.Proxies == nil { st.Proxies = map[string]types.Proxy{} }
 	if st.Clients == nil { st.Clients = map[string]types.Client{} }
 	if st.Mappings == nil { st.Mappings = map[string]types.Mapping{} }
+	if st.Policies == nil { st.Policies = map[string]types.DomainPolicy{} }
+	if st.Traffic == nil { st.Traffic = map[string]types.TrafficStat{} }
 	s.state = st
 	return nil
 }
@@ -72,15 +79,26 @@ func (s *fileStore) CreateProxy(p types.Proxy) types.Proxy {
 	s.mu.Lock(); defer s.mu.Unlock()
 	if p.ID == "" { p.ID = uuid.New().String() }
 	p.Status = types.StatusDown
+	p.Quota = limitsOf(p.Quota)
 	if s.state.Proxies == nil { s.state.Proxies = map[string]types.Proxy{} }
 	s.state.Proxies[p.ID] = p
 	_ = s.save()
 	return p
 }
 
+func (s *fileStore) GetProxy(id string) (types.Proxy, bool) {
+	s.mu.RLock(); defer s.mu.RUnlock()
+	p, ok := s.state.Proxies[id]
+	return p, ok
+}
+
 func (s *fileStore) UpdateProxy(p types.Proxy) (types.Proxy, bool) {
 	s.mu.Lock(); defer s.mu.Unlock()
-	if _, ok := s.state.Proxies[p.ID]; !ok { return types.Proxy{}, false }
+	old, ok := s.state.Proxies[p.ID]
+	if !ok { return types.Proxy{}, false }
+	p.Quota = old.Quota // only SetProxyQuota / AddTraffic touch it
+	// only SetProxyTelemetry touches these
+	p.Status, p.LatencyMs, p.ExitIP, p.LastCheckedAt = old.Status, old.LatencyMs, old.ExitIP, old.LastCheckedAt
 	s.state.Proxies[p.ID] = p
 	_ = s.save()
 	return p, true
@@ -92,7 +110,11 @@ func (s *fileStore) DeleteProxy(id string) bool {
 	delete(s.state.Proxies, id)
 	// cascade: xoá mapping tham chiếu tới proxy này
 	for mid, m := range s.state.Mappings {
-		if m.ProxyID == id { delete(s.state.Mappings, mid) }
+		if m.ProxyID == id { delete(s.state.Mappings, mid); continue }
+		if ids, ok := withoutID(m.BackupProxyIDs, id); ok {
+			m.BackupProxyIDs = ids
+			s.state.Mappings[mid] = m
+		}
 	}
 	_ = s.save()
 	return true
@@ -110,12 +132,24 @@ func (s *fileStore) ListClients() []types.Client {
 func (s *fileStore) CreateClient(c types.Client) types.Client {
 	s.mu.Lock(); defer s.mu.Unlock()
 	if c.ID == "" { c.ID = uuid.New().String() }
+	c.Quota = limitsOf(c.Quota)
 	if s.state.Clients == nil { s.state.Clients = map[string]types.Client{} }
 	s.state.Clients[c.ID] = c
 	_ = s.save()
 	return c
 }
 
+// UpdateClient replaces an existing client record; its quota is kept.
+func (s *fileStore) UpdateClient(c types.Client) (types.Client, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	old, ok := s.state.Clients[c.ID]
+	if !ok { return types.Client{}, false }
+	c.Quota = old.Quota
+	s.state.Clients[c.ID] = c
+	_ = s.save()
+	return c, true
+}
+
 func (s *fileStore) DeleteClient(id string) bool {
 	s.mu.Lock(); defer s.mu.Unlock()
 	if _, ok := s.state.Clients[id]; !ok { return false }
@@ -124,6 +158,9 @@ func (s *fileStore) DeleteClient(id string) bool {
 	for mid, m := range s.state.Mappings {
 		if m.ClientID == id { delete(s.state.Mappings, mid) }
 	}
+	for pid, p := range s.state.Policies {
+		if p.ClientID == id { delete(s.state.Policies, pid) }
+	}
 	_ = s.save()
 	return true
 }
@@ -140,15 +177,9 @@ func (s *fileStore) ListMappings() []types.MappingView {
 	tmp := []rec{}
 	for _, m := range s.state.Mappings {
 		cv, okc := s.state.Clients[m.ClientID]
-		pv, okp := s.state.Proxies[m.ProxyID]
+		_, okp := s.state.Proxies[m.ProxyID]
 		if !okc || !okp { continue }
-		r := rec{ mv: types.MappingView{
-			ID: m.ID,
-			Client: cv,
-			Proxy: pv,
-			State: m.State,
-			LocalRedirectPort: m.LocalRedirectPort,
-		}}
+		r := rec{ mv: viewOf(m, cv, s.state.Proxies) }
 		if m.LastAppliedAt != nil { r.ts = *m.LastAppliedAt; r.has = true }
 		tmp = append(tmp, r)
 	}
@@ -166,21 +197,49 @@ func (s *fileStore) CreateMapping(m types.Mapping) (types.MappingView, bool) {
 	s.mu.Lock(); defer s.mu.Unlock()
 	if _, ok := s.state.Clients[m.ClientID]; !ok { return types.MappingView{}, false }
 	if _, ok := s.state.Proxies[m.ProxyID]; !ok { return types.MappingView{}, false }
+	for _, id := range m.BackupProxyIDs {
+		if _, ok := s.state.Proxies[id]; !ok { return types.MappingView{}, false }
+	}
 	if m.ID == "" { m.ID = uuid.New().String() }
 	m.State = "PENDING"
+	m.ActiveProxyID, m.RotatedAt = "", nil
+	m.ExitIP, m.PrevExitIP, m.ExitHistory = "", "", nil
+	if p := s.state.Proxies[m.ProxyID]; p.ExitIP != nil {
+		noteExit(&m, p.ID, *p.ExitIP, time.Now())
+	}
 	if s.state.Mappings == nil { s.state.Mappings = map[string]types.Mapping{} }
 	s.state.Mappings[m.ID] = m
 	_ = s.save()
+	return viewOf(m, s.state.Clients[m.ClientID], s.state.Proxies), true
+}
 
-	cv := s.state.Clients[m.ClientID]
-	pv := s.state.Proxies[m.ProxyID]
-	return types.MappingView{
-		ID:                m.ID,
-		Client:            cv,
-		Proxy:             pv,
-		State:             m.State,
-		LocalRedirectPort: m.LocalRedirectPort,
-	}, true
+func (s *fileStore) GetMapping(id string) (types.Mapping, bool) {
+	s.mu.RLock(); defer s.mu.RUnlock()
+	m, ok := s.state.Mappings[id]
+	return m, ok
+}
+
+// UpdateMapping replaces a mapping record; client and pool proxies must exist.
+func (s *fileStore) UpdateMapping(m types.Mapping) (types.MappingView, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	if _, ok := s.state.Mappings[m.ID]; !ok { return types.MappingView{}, false }
+	if _, ok := s.state.Clients[m.ClientID]; !ok { return types.MappingView{}, false }
+	for _, id := range poolIDs(m) {
+		if _, ok := s.state.Proxies[id]; !ok { return types.MappingView{}, false }
+	}
+	s.state.Mappings[m.ID] = m
+	_ = s.save()
+	return viewOf(m, s.state.Clients[m.ClientID], s.state.Proxies), true
+}
+
+func (s *fileStore) RotateMapping(id string) (types.MappingView, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	m, ok := s.state.Mappings[id]
+	if !ok { return types.MappingView{}, false }
+	rotate(&m, s.state.Proxies, time.Now())
+	s.state.Mappings[id] = m
+	_ = s.save()
+	return viewOf(m, s.state.Clients[m.ClientID], s.state.Proxies), true
 }
 
 // ---------- Telemetry ----------
@@ -194,6 +253,14 @@ func (s *fileStore) SetProxyTelemetry(id string, status types.ProxyStatus, laten
 	if exitIP != "" { p.ExitIP = &exitIP } else { p.ExitIP = nil }
 	p.LastCheckedAt = &now
 	s.state.Proxies[id] = p
+	if exitIP != "" {
+		for mid, m := range s.state.Mappings {
+			if activeID(m) == id && m.ExitIP != exitIP {
+				noteExit(&m, id, exitIP, now)
+				s.state.Mappings[mid] = m
+			}
+		}
+	}
 	_ = s.save()
 }
 
@@ -231,3 +298,98 @@ func (s *fileStore) UpdateMappingState(id string, state string, localPort int) b
 	_ = s.save()
 	return true
 }
+
+// ---------- Domain policies ----------
+
+func (s *fileStore) ListPolicies() []types.DomainPolicy {
+	s.mu.RLock(); defer s.mu.RUnlock()
+	out := make([]types.DomainPolicy, 0, len(s.state.Policies))
+	for _, v := range s.state.Policies { out = append(out, v) }
+	sortPolicies(out)
+	return out
+}
+
+func (s *fileStore) CreatePolicy(p types.DomainPolicy) types.DomainPolicy {
+	s.mu.Lock(); defer s.mu.Unlock()
+	if p.ID == "" { p.ID = uuid.New().String() }
+	p.Hits, p.LastHitAt = 0, nil
+	s.state.Policies[p.ID] = p
+	_ = s.save()
+	return p
+}
+
+func (s *fileStore) DeletePolicy(id string) bool {
+	s.mu.Lock(); defer s.mu.Unlock()
+	if _, ok := s.state.Policies[id]; !ok { return false }
+	delete(s.state.Policies, id)
+	_ = s.save()
+	return true
+}
+
+func (s *fileStore) AddPolicyHits(hits map[string]int64) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	addPolicyHits(s.state.Policies, hits, time.Now())
+	_ = s.save()
+}
+
+// ---------- Traffic accounting ----------
+
+func (s *fileStore) AddTraffic(recs []types.ConnRecord) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	addTraffic(s.state.Traffic, recs)
+	chargeQuotas(s.state.Clients, s.state.Proxies, recs)
+	s.recent = appendRecent(s.recent, recs)
+	_ = s.save()
+}
+
+func (s *fileStore) ListTraffic(clientID, proxyID, fromDay, toDay string) []types.TrafficStat {
+	s.mu.RLock(); defer s.mu.RUnlock()
+	return filterTraffic(s.state.Traffic, clientID, proxyID, fromDay, toDay)
+}
+
+func (s *fileStore) RecentConns(limit int) []types.ConnRecord {
+	s.mu.RLock(); defer s.mu.RUnlock()
+	return latestConns(s.recent, limit)
+}
+
+// ---------- Quotas ----------
+
+func (s *fileStore) SetClientQuota(id string, q *types.Quota) (types.Client, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	c, ok := s.state.Clients[id]
+	if !ok { return types.Client{}, false }
+	c.Quota = withLimits(c.Quota, q)
+	s.state.Clients[id] = c
+	_ = s.save()
+	return c, true
+}
+
+func (s *fileStore) SetProxyQuota(id string, q *types.Quota) (types.Proxy, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	p, ok := s.state.Proxies[id]
+	if !ok { return types.Proxy{}, false }
+	p.Quota = withLimits(p.Quota, q)
+	s.state.Proxies[id] = p
+	_ = s.save()
+	return p, true
+}
+
+func (s *fileStore) ResetClientQuota(id string) (types.Client, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	c, ok := s.state.Clients[id]
+	if !ok { return types.Client{}, false }
+	c.Quota = limitsOf(c.Quota)
+	s.state.Clients[id] = c
+	_ = s.save()
+	return c, true
+}
+
+func (s *fileStore) ResetProxyQuota(id string) (types.Proxy, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	p, ok := s.state.Proxies[id]
+	if !ok { return types.Proxy{}, false }
+	p.Quota = limitsOf(p.Quota)
+	s.state.Proxies[id] = p
+	_ = s.save()
+	return p, true
+}
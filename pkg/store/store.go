@@ -14,24 +14,56 @@ import (
 type Store interface {
 	// Proxies
 	ListProxies() []types.Proxy
+	GetProxy(id string) (types.Proxy, bool)
 	CreateProxy(p types.Proxy) types.Proxy
+	// UpdateProxy replaces a proxy's settings; its quota and telemetry are
+	// kept, so an edit can't undo a concurrent health check.
 	UpdateProxy(p types.Proxy) (types.Proxy, bool)
 	DeleteProxy(id string) bool
 
 	// Clients
 	ListClients() []types.Client
 	CreateClient(c types.Client) types.Client
+	UpdateClient(c types.Client) (types.Client, bool)
 	DeleteClient(id string) bool // NEW
 
 	// Mappings
 	ListMappings() []types.MappingView
+	GetMapping(id string) (types.Mapping, bool)
 	CreateMapping(m types.Mapping) (types.MappingView, bool)
+	UpdateMapping(m types.Mapping) (types.MappingView, bool)
 	DeleteMapping(id string) bool // NEW
 	// UpdateMappingState updates mapping.state and optionally its local redirect port
 	UpdateMappingState(id string, state string, localPort int) bool
+	// RotateMapping moves the mapping to the next usable proxy of its pool
+	// and records the exit IP change.
+	RotateMapping(id string) (types.MappingView, bool)
 
 	// Telemetry
 	SetProxyTelemetry(id string, status types.ProxyStatus, latency int, exitIP string)
+
+	// Domain policies
+	ListPolicies() []types.DomainPolicy
+	CreatePolicy(p types.DomainPolicy) types.DomainPolicy
+	DeletePolicy(id string) bool
+	// AddPolicyHits adds forwarder-reported hit counts keyed by policy id.
+	AddPolicyHits(hits map[string]int64)
+
+	// Traffic accounting
+	// AddTraffic folds finished connections into the per-day stats.
+	AddTraffic(recs []types.ConnRecord)
+	// ListTraffic returns daily stats; empty filters match all, days are
+	// "2006-01-02" and inclusive.
+	ListTraffic(clientID, proxyID, fromDay, toDay string) []types.TrafficStat
+	// RecentConns returns up to limit of the latest connections, newest first.
+	RecentConns(limit int) []types.ConnRecord
+
+	// Quotas. AddTraffic charges usage; these set the limits (nil removes
+	// them, usage is kept) or zero the usage counters.
+	SetClientQuota(id string, q *types.Quota) (types.Client, bool)
+	SetProxyQuota(id string, q *types.Quota) (types.Proxy, bool)
+	ResetClientQuota(id string) (types.Client, bool)
+	ResetProxyQuota(id string) (types.Proxy, bool)
 }
 
 type memoryStore struct {
@@ -39,6 +71,9 @@ type memoryStore struct {
 	proxies  map[string]types.Proxy
 	clients  map[string]types.Client
 	mappings map[string]types.Mapping
+	policies map[string]types.DomainPolicy
+	traffic  map[string]types.TrafficStat
+	recent   []types.ConnRecord
 }
 
 func NewMemory() Store {
@@ -46,6 +81,8 @@ func NewMemory() Store {
 		proxies:  make(map[string]types.Proxy),
 		clients:  make(map[string]types.Client),
 		mappings: make(map[string]types.Mapping),
+		policies: make(map[string]types.DomainPolicy),
+		traffic:  make(map[string]types.TrafficStat),
 	}
 
 	// Seed demo (có thể bỏ)
@@ -81,13 +118,24 @@ func (s *memoryStore) CreateProxy(p types.Proxy) types.Proxy {
 	s.mu.Lock(); defer s.mu.Unlock()
 	if p.ID == "" { p.ID = uuid.New().String() }
 	p.Status = types.StatusDown
+	p.Quota = limitsOf(p.Quota)
 	s.proxies[p.ID] = p
 	return p
 }
 
+func (s *memoryStore) GetProxy(id string) (types.Proxy, bool) {
+	s.mu.RLock(); defer s.mu.RUnlock()
+	p, ok := s.proxies[id]
+	return p, ok
+}
+
 func (s *memoryStore) UpdateProxy(p types.Proxy) (types.Proxy, bool) {
 	s.mu.Lock(); defer s.mu.Unlock()
-	if _, ok := s.proxies[p.ID]; !ok { return types.Proxy{}, false }
+	old, ok := s.proxies[p.ID]
+	if !ok { return types.Proxy{}, false }
+	p.Quota = old.Quota // only SetProxyQuota / AddTraffic touch it
+	// only SetProxyTelemetry touches these
+	p.Status, p.LatencyMs, p.ExitIP, p.LastCheckedAt = old.Status, old.LatencyMs, old.ExitIP, old.LastCheckedAt
 	s.proxies[p.ID] = p
 	return p, true
 }
@@ -98,7 +146,11 @@ func (s *memoryStore) DeleteProxy(id string) bool {
 	delete(s.proxies, id)
 	// tuỳ chọn: xoá các mapping tham chiếu tới proxy này
 	for mid, m := range s.mappings {
-		if m.ProxyID == id { delete(s.mappings, mid) }
+		if m.ProxyID == id { delete(s.mappings, mid); continue }
+		if ids, ok := withoutID(m.BackupProxyIDs, id); ok {
+			m.BackupProxyIDs = ids
+			s.mappings[mid] = m
+		}
 	}
 	return true
 }
@@ -115,10 +167,21 @@ func (s *memoryStore) ListClients() []types.Client {
 func (s *memoryStore) CreateClient(c types.Client) types.Client {
 	s.mu.Lock(); defer s.mu.Unlock()
 	if c.ID == "" { c.ID = uuid.New().String() }
+	c.Quota = limitsOf(c.Quota)
 	s.clients[c.ID] = c
 	return c
 }
 
+// UpdateClient replaces an existing client record; its quota is kept.
+func (s *memoryStore) UpdateClient(c types.Client) (types.Client, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	old, ok := s.clients[c.ID]
+	if !ok { return types.Client{}, false }
+	c.Quota = old.Quota
+	s.clients[c.ID] = c
+	return c, true
+}
+
 func (s *memoryStore) DeleteClient(id string) bool {
 	s.mu.Lock(); defer s.mu.Unlock()
 	if _, ok := s.clients[id]; !ok { return false }
@@ -127,6 +190,9 @@ func (s *memoryStore) DeleteClient(id string) bool {
 	for mid, m := range s.mappings {
 		if m.ClientID == id { delete(s.mappings, mid) }
 	}
+	for pid, p := range s.policies {
+		if p.ClientID == id { delete(s.policies, pid) }
+	}
 	return true
 }
 
@@ -142,23 +208,15 @@ func (s *memoryStore) ListMappings() []types.MappingView {
 	tmp := []rec{}
 	for _, m := range s.mappings {
 		cv, okc := s.clients[m.ClientID]
-		pv, okp := s.proxies[m.ProxyID]
+		_, okp := s.proxies[m.ProxyID]
 		if !okc || !okp { continue }
-		r := rec{
-			mv: types.MappingView{
-				ID:                m.ID,
-				Client:            cv,
-				Proxy:             pv,
-				State:             m.State,
-				LocalRedirectPort: m.LocalRedirectPort,
-			},
-		}
+		r := rec{mv: viewOf(m, cv, s.proxies)}
 		if m.LastAppliedAt != nil {
 			r.ts = *m.LastAppliedAt
 			r.has = true
+		}
 		tmp = append(tmp, r)
 	}
-}
 	sort.SliceStable(tmp, func(i, j int) bool {
 		if tmp[i].has && tmp[j].has {
 			return tmp[i].ts.After(tmp[j].ts)
@@ -178,18 +236,44 @@ func (s *memoryStore) CreateMapping(m types.Mapping) (types.MappingView, bool) {
 	if m.ID == "" { m.ID = uuid.New().String() }
 	if _, ok := s.clients[m.ClientID]; !ok { return types.MappingView{}, false }
 	if _, ok := s.proxies[m.ProxyID]; !ok { return types.MappingView{}, false }
+	for _, id := range m.BackupProxyIDs {
+		if _, ok := s.proxies[id]; !ok { return types.MappingView{}, false }
+	}
 	m.State = "PENDING"
+	m.ActiveProxyID, m.RotatedAt = "", nil
+	m.ExitIP, m.PrevExitIP, m.ExitHistory = "", "", nil
+	if p := s.proxies[m.ProxyID]; p.ExitIP != nil {
+		noteExit(&m, p.ID, *p.ExitIP, time.Now())
+	}
 	s.mappings[m.ID] = m
+	return viewOf(m, s.clients[m.ClientID], s.proxies), true
+}
 
-	cv := s.clients[m.ClientID]
-	pv := s.proxies[m.ProxyID]
-	return types.MappingView{
-		ID:                m.ID,
-		Client:            cv,
-		Proxy:             pv,
-		State:             m.State,
-		LocalRedirectPort: m.LocalRedirectPort,
-	}, true
+func (s *memoryStore) GetMapping(id string) (types.Mapping, bool) {
+	s.mu.RLock(); defer s.mu.RUnlock()
+	m, ok := s.mappings[id]
+	return m, ok
+}
+
+// UpdateMapping replaces a mapping record; client and pool proxies must exist.
+func (s *memoryStore) UpdateMapping(m types.Mapping) (types.MappingView, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	if _, ok := s.mappings[m.ID]; !ok { return types.MappingView{}, false }
+	if _, ok := s.clients[m.ClientID]; !ok { return types.MappingView{}, false }
+	for _, id := range poolIDs(m) {
+		if _, ok := s.proxies[id]; !ok { return types.MappingView{}, false }
+	}
+	s.mappings[m.ID] = m
+	return viewOf(m, s.clients[m.ClientID], s.proxies), true
+}
+
+func (s *memoryStore) RotateMapping(id string) (types.MappingView, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	m, ok := s.mappings[id]
+	if !ok { return types.MappingView{}, false }
+	rotate(&m, s.proxies, time.Now())
+	s.mappings[id] = m
+	return viewOf(m, s.clients[m.ClientID], s.proxies), true
 }
 
 func (s *memoryStore) DeleteMapping(id string) bool {
@@ -216,6 +300,121 @@ func (s *memoryStore) UpdateMappingState(id string, state string, localPort int)
 	return true
 }
 
+// backupsOf resolves a mapping's backup proxies in order, skipping deleted ones.
+func backupsOf(m types.Mapping, proxies map[string]types.Proxy) []types.Proxy {
+	var out []types.Proxy
+	for _, id := range m.BackupProxyIDs {
+		if p, ok := proxies[id]; ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// withoutID returns ids minus id and whether id was present.
+func withoutID(ids []string, id string) ([]string, bool) {
+	out := make([]string, 0, len(ids))
+	for _, v := range ids {
+		if v != id {
+			out = append(out, v)
+		}
+	}
+	return out, len(out) != len(ids)
+}
+
+// viewOf joins a mapping with its client and pool proxies.
+func viewOf(m types.Mapping, c types.Client, proxies map[string]types.Proxy) types.MappingView {
+	return types.MappingView{
+		ID:                m.ID,
+		Client:            c,
+		Proxy:             proxies[m.ProxyID],
+		Backups:           backupsOf(m, proxies),
+		State:             m.State,
+		LocalRedirectPort: m.LocalRedirectPort,
+		Rotation:          m.Rotation,
+		ActiveProxyID:     activeID(m),
+		RotatedAt:         m.RotatedAt,
+		ExitIP:            m.ExitIP,
+		PrevExitIP:        m.PrevExitIP,
+		StickyTTLSec:      m.StickyTTLSec,
+		RateLimit:         m.RateLimit,
+		IdleTimeoutSec:    m.IdleTimeoutSec,
+		ConnectByHost:     m.ConnectByHost,
+		PrewarmConns:      m.PrewarmConns,
+		Quota:             quotaStateOf(c, poolOf(m, proxies), time.Now()),
+	}
+}
+
+// poolOf returns the mapping's existing proxies in failover order.
+func poolOf(m types.Mapping, proxies map[string]types.Proxy) []types.Proxy {
+	var out []types.Proxy
+	for _, id := range poolIDs(m) {
+		if p, ok := proxies[id]; ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// poolIDs lists the mapping's proxies in failover order.
+func poolIDs(m types.Mapping) []string {
+	return append([]string{m.ProxyID}, m.BackupProxyIDs...)
+}
+
+// activeID returns the pool member the mapping currently exits through.
+func activeID(m types.Mapping) string {
+	for _, id := range m.BackupProxyIDs {
+		if id == m.ActiveProxyID {
+			return id
+		}
+	}
+	return m.ProxyID
+}
+
+const maxExitHistory = 100
+
+// noteExit records that m now leaves via proxyID with exit IP ip.
+func noteExit(m *types.Mapping, proxyID, ip string, now time.Time) {
+	if n := len(m.ExitHistory); n > 0 && m.ExitHistory[n-1].ProxyID == proxyID && m.ExitIP == ip {
+		return
+	}
+	if m.ExitIP != ip {
+		m.PrevExitIP = m.ExitIP
+		m.ExitIP = ip
+	}
+	m.ExitHistory = append(m.ExitHistory, types.ExitRecord{ProxyID: proxyID, ExitIP: ip, At: now})
+	if n := len(m.ExitHistory); n > maxExitHistory {
+		m.ExitHistory = append([]types.ExitRecord(nil), m.ExitHistory[n-maxExitHistory:]...)
+	}
+}
+
+// rotate advances m to the next enabled, non-DOWN pool member after the
+// active one. With no usable alternative the mapping stays where it is.
+func rotate(m *types.Mapping, proxies map[string]types.Proxy, now time.Time) {
+	ids := poolIDs(*m)
+	cur := 0
+	for i, id := range ids {
+		if id == activeID(*m) {
+			cur = i
+			break
+		}
+	}
+	for step := 1; step < len(ids); step++ {
+		p, ok := proxies[ids[(cur+step)%len(ids)]]
+		if !ok || !p.Enabled || p.Status == types.StatusDown {
+			continue
+		}
+		ip := ""
+		if p.ExitIP != nil {
+			ip = *p.ExitIP
+		}
+		m.ActiveProxyID = p.ID
+		m.RotatedAt = &now
+		noteExit(m, p.ID, ip, now)
+		return
+	}
+}
+
 // ---------- Telemetry ----------
 
 func (s *memoryStore) SetProxyTelemetry(id string, status types.ProxyStatus, latency int, exitIP string) {
@@ -227,4 +426,286 @@ func (s *memoryStore) SetProxyTelemetry(id string, status types.ProxyStatus, lat
 	if exitIP != "" { p.ExitIP = &exitIP } else { p.ExitIP = nil }
 	p.LastCheckedAt = &now
 	s.proxies[id] = p
+	if exitIP == "" { return }
+	for mid, m := range s.mappings {
+		if activeID(m) == id && m.ExitIP != exitIP {
+			noteExit(&m, id, exitIP, now)
+			s.mappings[mid] = m
+		}
+	}
+}
+
+// ---------- Domain policies ----------
+
+func (s *memoryStore) ListPolicies() []types.DomainPolicy {
+	s.mu.RLock(); defer s.mu.RUnlock()
+	out := make([]types.DomainPolicy, 0, len(s.policies))
+	for _, v := range s.policies { out = append(out, v) }
+	sortPolicies(out)
+	return out
+}
+
+func (s *memoryStore) CreatePolicy(p types.DomainPolicy) types.DomainPolicy {
+	s.mu.Lock(); defer s.mu.Unlock()
+	if p.ID == "" { p.ID = uuid.New().String() }
+	p.Hits, p.LastHitAt = 0, nil
+	s.policies[p.ID] = p
+	return p
+}
+
+func (s *memoryStore) DeletePolicy(id string) bool {
+	s.mu.Lock(); defer s.mu.Unlock()
+	if _, ok := s.policies[id]; !ok { return false }
+	delete(s.policies, id)
+	return true
+}
+
+func (s *memoryStore) AddPolicyHits(hits map[string]int64) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	addPolicyHits(s.policies, hits, time.Now())
+}
+
+// sortPolicies orders global entries first, then by client, list, pattern.
+func sortPolicies(ps []types.DomainPolicy) {
+	sort.SliceStable(ps, func(i, j int) bool {
+		if ps[i].ClientID != ps[j].ClientID {
+			return ps[i].ClientID < ps[j].ClientID
+		}
+		if ps[i].List != ps[j].List {
+			return ps[i].List < ps[j].List
+		}
+		if ps[i].Pattern != ps[j].Pattern {
+			return ps[i].Pattern < ps[j].Pattern
+		}
+		return ps[i].ID < ps[j].ID
+	})
+}
+
+func addPolicyHits(policies map[string]types.DomainPolicy, hits map[string]int64, now time.Time) {
+	for id, n := range hits {
+		p, ok := policies[id]
+		if !ok || n <= 0 {
+			continue
+		}
+		p.Hits += n
+		p.LastHitAt = &now
+		policies[id] = p
+	}
+}
+
+// ---------- Traffic accounting ----------
+
+func (s *memoryStore) AddTraffic(recs []types.ConnRecord) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	addTraffic(s.traffic, recs)
+	chargeQuotas(s.clients, s.proxies, recs)
+	s.recent = appendRecent(s.recent, recs)
+}
+
+func (s *memoryStore) ListTraffic(clientID, proxyID, fromDay, toDay string) []types.TrafficStat {
+	s.mu.RLock(); defer s.mu.RUnlock()
+	return filterTraffic(s.traffic, clientID, proxyID, fromDay, toDay)
+}
+
+func (s *memoryStore) RecentConns(limit int) []types.ConnRecord {
+	s.mu.RLock(); defer s.mu.RUnlock()
+	return latestConns(s.recent, limit)
+}
+
+// maxRecentConns caps the in-memory connection log; older records only
+// survive in the daily stats.
+const maxRecentConns = 1000
+
+func trafficKey(clientID, proxyID, day string) string {
+	return clientID + "|" + proxyID + "|" + day
+}
+
+func addTraffic(traffic map[string]types.TrafficStat, recs []types.ConnRecord) {
+	for _, r := range recs {
+		day := r.End.UTC().Format("2006-01-02")
+		k := trafficKey(r.ClientID, r.ProxyID, day)
+		t, ok := traffic[k]
+		if !ok {
+			t = types.TrafficStat{ClientID: r.ClientID, ProxyID: r.ProxyID, Day: day}
+		}
+		t.Conns++
+		t.BytesUp += r.BytesUp
+		t.BytesDown += r.BytesDown
+		if d := r.End.Sub(r.Start); d > 0 {
+			t.DurationMs += d.Milliseconds()
+		}
+		traffic[k] = t
+	}
+}
+
+func appendRecent(recent, recs []types.ConnRecord) []types.ConnRecord {
+	recent = append(recent, recs...)
+	if over := len(recent) - maxRecentConns; over > 0 {
+		recent = append([]types.ConnRecord(nil), recent[over:]...)
+	}
+	return recent
+}
+
+func latestConns(recent []types.ConnRecord, limit int) []types.ConnRecord {
+	if limit <= 0 || limit > len(recent) {
+		limit = len(recent)
+	}
+	out := make([]types.ConnRecord, 0, limit)
+	for i := len(recent) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, recent[i])
+	}
+	return out
+}
+
+func filterTraffic(traffic map[string]types.TrafficStat, clientID, proxyID, fromDay, toDay string) []types.TrafficStat {
+	out := []types.TrafficStat{}
+	for _, t := range traffic {
+		if clientID != "" && t.ClientID != clientID || proxyID != "" && t.ProxyID != proxyID {
+			continue
+		}
+		if fromDay != "" && t.Day < fromDay || toDay != "" && t.Day > toDay {
+			continue
+		}
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Day != out[j].Day {
+			return out[i].Day < out[j].Day
+		}
+		if out[i].ClientID != out[j].ClientID {
+			return out[i].ClientID < out[j].ClientID
+		}
+		return out[i].ProxyID < out[j].ProxyID
+	})
+	return out
+}
+
+// ---------- Quotas ----------
+
+func (s *memoryStore) SetClientQuota(id string, q *types.Quota) (types.Client, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	c, ok := s.clients[id]
+	if !ok { return types.Client{}, false }
+	c.Quota = withLimits(c.Quota, q)
+	s.clients[id] = c
+	return c, true
+}
+
+func (s *memoryStore) SetProxyQuota(id string, q *types.Quota) (types.Proxy, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	p, ok := s.proxies[id]
+	if !ok { return types.Proxy{}, false }
+	p.Quota = withLimits(p.Quota, q)
+	s.proxies[id] = p
+	return p, true
+}
+
+func (s *memoryStore) ResetClientQuota(id string) (types.Client, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	c, ok := s.clients[id]
+	if !ok { return types.Client{}, false }
+	c.Quota = limitsOf(c.Quota)
+	s.clients[id] = c
+	return c, true
+}
+
+func (s *memoryStore) ResetProxyQuota(id string) (types.Proxy, bool) {
+	s.mu.Lock(); defer s.mu.Unlock()
+	p, ok := s.proxies[id]
+	if !ok { return types.Proxy{}, false }
+	p.Quota = limitsOf(p.Quota)
+	s.proxies[id] = p
+	return p, true
+}
+
+// limitsOf keeps only the limits of q (usage is never taken from callers).
+func limitsOf(q *types.Quota) *types.Quota {
+	if q == nil || q.DailyBytes <= 0 && q.MonthlyBytes <= 0 {
+		return nil
+	}
+	return &types.Quota{DailyBytes: q.DailyBytes, MonthlyBytes: q.MonthlyBytes}
+}
+
+// withLimits applies the limits of q to cur, keeping cur's usage.
+func withLimits(cur, q *types.Quota) *types.Quota {
+	out := limitsOf(q)
+	if out == nil || cur == nil {
+		return out
+	}
+	out.UsedDay, out.UsedMonth, out.Day, out.Month = cur.UsedDay, cur.UsedMonth, cur.Day, cur.Month
+	return out
+}
+
+// charge adds n bytes at now, starting a new period's counter when needed.
+func charge(q *types.Quota, n int64, now time.Time) {
+	now = now.UTC()
+	if day := now.Format("2006-01-02"); q.Day != day {
+		q.Day, q.UsedDay = day, 0
+	}
+	if month := now.Format("2006-01"); q.Month != month {
+		q.Month, q.UsedMonth = month, 0
+	}
+	q.UsedDay += n
+	q.UsedMonth += n
+}
+
+// chargeQuotas bills finished connections to the client's and the proxy's
+// quota; records without a quota on either side only feed the stats.
+func chargeQuotas(clients map[string]types.Client, proxies map[string]types.Proxy, recs []types.ConnRecord) {
+	for _, r := range recs {
+		n := r.BytesUp + r.BytesDown
+		if c, ok := clients[r.ClientID]; ok && c.Quota != nil {
+			q := *c.Quota
+			charge(&q, n, r.End)
+			c.Quota = &q
+			clients[r.ClientID] = c
+		}
+		if p, ok := proxies[r.ProxyID]; ok && p.Quota != nil {
+			q := *p.Quota
+			charge(&q, n, r.End)
+			p.Quota = &q
+			proxies[r.ProxyID] = p
+		}
+	}
+}
+
+// quotaStateOf reports whether the client is over quota, or every enabled
+// proxy of its pool is; nil when neither side has a limit.
+func quotaStateOf(c types.Client, pool []types.Proxy, now time.Time) *types.QuotaState {
+	st := &types.QuotaState{}
+	limited := false
+	if left, ok := c.Quota.Remaining(now); ok {
+		limited = true
+		st.ClientRemaining = &left
+		if left <= 0 {
+			st.Exceeded, st.Reason = true, "client quota"
+		}
+	}
+	// the pool only runs dry when every enabled member has a limit
+	best, members, unlimited := int64(0), 0, false
+	for _, p := range pool {
+		if !p.Enabled {
+			continue
+		}
+		members++
+		left, ok := p.Quota.Remaining(now)
+		if !ok {
+			unlimited = true
+			break
+		}
+		if left > best {
+			best = left
+		}
+	}
+	if members > 0 && !unlimited {
+		limited = true
+		st.ProxyRemaining = &best
+		if best <= 0 && !st.Exceeded {
+			st.Exceeded, st.Reason = true, "proxy quota"
+		}
+	}
+	if !limited {
+		return nil
+	}
+	return st
 }
@@ -13,7 +13,7 @@ const (
 type Proxy struct {
 	ID            string      `json:"id"`
 	Label         string      `json:"label,omitempty"`
-	Type          string      `json:"type"` // "http" | "socks5"
+	Type          string      `json:"type"` // "http" | "https" | "socks5" | "socks4" | "ssh" | "shadowsocks"
 	Host          string      `json:"host"`
 	Port          int         `json:"port"`
 	Username      *string     `json:"username,omitempty"`
@@ -23,29 +23,258 @@ type Proxy struct {
 	LatencyMs     *int        `json:"latency_ms,omitempty"`
 	ExitIP        *string     `json:"exit_ip,omitempty"`
 	LastCheckedAt *time.Time  `json:"last_checked_at,omitempty"`
+	Quota         *Quota      `json:"quota,omitempty"`
+	RateLimit     *RateLimit  `json:"rate_limit,omitempty"` // shared by every connection through this proxy
+	TLS           *ProxyTLS   `json:"tls,omitempty"`        // type "https"
+	SSH           *ProxySSH   `json:"ssh,omitempty"`        // type "ssh"
+	Cipher        string      `json:"cipher,omitempty"`     // type "shadowsocks": AEAD method, key from Password
+	// PlainHTTP (types "http"/"https") sends plain HTTP as absolute-URI
+	// requests to the proxy instead of CONNECT, for providers that refuse
+	// CONNECT to port 80.
+	PlainHTTP bool `json:"plain_http,omitempty"`
+	// AuthScheme (types "http"/"https") is how the credentials go: "" sends
+	// none until the proxy's 407 and answers the scheme it asks for,
+	// "basic" sends Basic up front (one round trip less), "digest" never
+	// falls back to Basic.
+	AuthScheme string `json:"auth_scheme,omitempty"`
+	// ProxyProtocol (1 or 2) makes pgw-fwd open its connection to this
+	// proxy with a PROXY protocol header naming the LAN client and the
+	// original destination; 0 = off.
+	ProxyProtocol int `json:"proxy_protocol,omitempty"`
+	// Chain lists the proxies (by ID, in order) to pass through before
+	// this one, e.g. a fixed jump host in front of a residential provider.
+	Chain []string `json:"chain,omitempty"`
+}
+
+// ProxyTLS configures the TLS session to an "https" proxy itself.
+type ProxyTLS struct {
+	ServerName         string `json:"server_name,omitempty"` // SNI and name to verify; default Host
+	CAPEM              string `json:"ca_pem,omitempty"`      // extra trusted root(s), PEM
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// ProxySSH configures an "ssh" upstream: Username authenticates with
+// Password and/or PrivateKey, and the server key must match HostKey.
+type ProxySSH struct {
+	PrivateKey            string `json:"private_key,omitempty"` // PEM
+	Passphrase            string `json:"passphrase,omitempty"`  // for an encrypted PrivateKey
+	HostKey               string `json:"host_key,omitempty"`    // authorized_keys format, e.g. "ssh-ed25519 AAAA..."
+	InsecureIgnoreHostKey bool   `json:"insecure_ignore_host_key,omitempty"`
 }
 
 type Client struct {
+	ID        string     `json:"id"`
+	IPCidr    string     `json:"ip_cidr"`
+	Note      string     `json:"note,omitempty"`
+	Enabled   bool       `json:"enabled"`
+	Rules     []Rule     `json:"rules,omitempty"` // evaluated in order, first match wins
+	Quota     *Quota     `json:"quota,omitempty"`
+	RateLimit *RateLimit `json:"rate_limit,omitempty"` // shared by all the client's connections
+	MaxConns  int        `json:"max_conns,omitempty"`  // concurrent connections; 0 = forwarder default, -1 = unlimited
+}
+
+// RateLimit shapes traffic with a token bucket; a zero rate is unlimited.
+type RateLimit struct {
+	UpKbps   int `json:"up_kbps,omitempty"`   // client → upstream
+	DownKbps int `json:"down_kbps,omitempty"` // upstream → client
+	BurstKB  int `json:"burst_kb,omitempty"`  // bucket size; 0 = one second at the rate
+}
+
+// Quota caps the bytes (up + down) a client or proxy may move per UTC day
+// and per calendar month; a zero limit is unlimited. Used counters start
+// over when Day / Month no longer match the current period.
+type Quota struct {
+	DailyBytes   int64  `json:"daily_bytes,omitempty"`
+	MonthlyBytes int64  `json:"monthly_bytes,omitempty"`
+	UsedDay      int64  `json:"used_day"`
+	UsedMonth    int64  `json:"used_month"`
+	Day          string `json:"day,omitempty"`   // "2006-01-02" UsedDay belongs to
+	Month        string `json:"month,omitempty"` // "2006-01" UsedMonth belongs to
+}
+
+// Used returns the bytes counted in the current day and month at now.
+func (q *Quota) Used(now time.Time) (day, month int64) {
+	if q == nil {
+		return 0, 0
+	}
+	now = now.UTC()
+	if q.Day == now.Format("2006-01-02") {
+		day = q.UsedDay
+	}
+	if q.Month == now.Format("2006-01") {
+		month = q.UsedMonth
+	}
+	return day, month
+}
+
+// Remaining returns the bytes left under the tighter of the two limits, and
+// false when neither limit is set.
+func (q *Quota) Remaining(now time.Time) (int64, bool) {
+	if q == nil || q.DailyBytes <= 0 && q.MonthlyBytes <= 0 {
+		return 0, false
+	}
+	day, month := q.Used(now)
+	left := q.DailyBytes - day
+	if q.DailyBytes <= 0 || q.MonthlyBytes > 0 && q.MonthlyBytes-month < left {
+		left = q.MonthlyBytes - month
+	}
+	if left < 0 {
+		left = 0
+	}
+	return left, true
+}
+
+// Exceeded reports whether a limit has been reached; nil is never exceeded.
+func (q *Quota) Exceeded(now time.Time) bool {
+	left, limited := q.Remaining(now)
+	return limited && left <= 0
+}
+
+// QuotaState summarises the quotas that apply to a mapping.
+type QuotaState struct {
+	Exceeded bool   `json:"exceeded"`
+	Reason   string `json:"reason,omitempty"` // "client quota" | "proxy quota"
+	// Bytes left for the client and for the pool's proxies (the most any
+	// usable member has left); nil when there is no limit.
+	ClientRemaining *int64 `json:"client_remaining_bytes,omitempty"`
+	ProxyRemaining  *int64 `json:"proxy_remaining_bytes,omitempty"`
+}
+
+// Rule routes a client's connections by destination host (SNI/Host).
+// Connections matching no rule go through the mapping's pool as usual.
+type Rule struct {
 	ID      string `json:"id"`
-	IPCidr  string `json:"ip_cidr"`
-	Note    string `json:"note,omitempty"`
-	Enabled bool   `json:"enabled"`
+	Match   string `json:"match"` // "exact" | "suffix" | "wildcard" | "regex"
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`             // "proxy" | "direct" | "reject"
+	ProxyID string `json:"proxy_id,omitempty"` // action "proxy"
+}
+
+// DomainPolicy is one entry of the global (ClientID "") or a per-client
+// domain list. A host matching any "deny" entry is refused; once a client
+// has "allow" entries (own or global), hosts matching none of them are refused too.
+type DomainPolicy struct {
+	ID        string     `json:"id"`
+	ClientID  string     `json:"client_id,omitempty"`
+	List      string     `json:"list"`  // "deny" | "allow"
+	Match     string     `json:"match"` // "exact" | "suffix" | "wildcard" | "regex"
+	Pattern   string     `json:"pattern"`
+	Note      string     `json:"note,omitempty"`
+	Hits      int64      `json:"hits"` // connections this entry decided
+	LastHitAt *time.Time `json:"last_hit_at,omitempty"`
+}
+
+// ConnRecord is one finished forwarder connection, as reported by pgw-fwd.
+type ConnRecord struct {
+	ClientID  string    `json:"client_id,omitempty"`
+	ClientIP  string    `json:"client_ip"`
+	MappingID string    `json:"mapping_id,omitempty"`
+	ProxyID   string    `json:"proxy_id,omitempty"` // "" = direct
+	Upstream  string    `json:"upstream"`
+	Dst       string    `json:"dst"`
+	Host      string    `json:"host,omitempty"` // masked SNI/Host
+	BytesUp   int64     `json:"bytes_up"`       // client → upstream
+	BytesDown int64     `json:"bytes_down"`     // upstream → client
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+}
+
+// TrafficStat aggregates connections of one client through one proxy over
+// one UTC day ("2006-01-02"); ProxyID "" is direct traffic.
+type TrafficStat struct {
+	ClientID   string `json:"client_id"`
+	ProxyID    string `json:"proxy_id"`
+	Day        string `json:"day"`
+	Conns      int64  `json:"conns"`
+	BytesUp    int64  `json:"bytes_up"`
+	BytesDown  int64  `json:"bytes_down"`
+	DurationMs int64  `json:"duration_ms"`
 }
 
 type Mapping struct {
 	ID                string     `json:"id"`
 	ClientID          string     `json:"client_id"`
 	ProxyID           string     `json:"proxy_id"`
-	Protocol          string     `json:"protocol"` // "http" | "socks5"
+	BackupProxyIDs    []string   `json:"backup_proxy_ids,omitempty"` // failover order after ProxyID
+	Protocol          string     `json:"protocol"`                   // "http" | "socks5"
 	LocalRedirectPort int        `json:"local_redirect_port"`
 	State             string     `json:"state"` // "APPLIED" | "PENDING" | "FAILED"
 	LastAppliedAt     *time.Time `json:"last_applied_at,omitempty"`
+
+	// Exit-IP rotation over the pool (ProxyID + BackupProxyIDs).
+	Rotation      *Rotation    `json:"rotation,omitempty"`
+	ActiveProxyID string       `json:"active_proxy_id,omitempty"` // pool member in use; "" = ProxyID
+	RotatedAt     *time.Time   `json:"rotated_at,omitempty"`
+	ExitIP        string       `json:"exit_ip,omitempty"`
+	PrevExitIP    string       `json:"prev_exit_ip,omitempty"`
+	ExitHistory   []ExitRecord `json:"exit_history,omitempty"` // newest last, capped
+
+	// StickyTTLSec pins a (client, SNI/Host) pair to the upstream it last used
+	// for this many seconds; 0 disables host affinity.
+	StickyTTLSec int `json:"sticky_ttl_sec,omitempty"`
+
+	// RateLimit overrides the client's rate limit for this mapping.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+
+	// IdleTimeoutSec closes a connection once neither direction has carried
+	// data for this long; 0 uses the forwarder default (PGW_FWD_IDLE_TIMEOUT).
+	IdleTimeoutSec int `json:"idle_timeout_sec,omitempty"`
+
+	// ConnectByHost makes pgw-fwd ask the upstream for the SNI/Host name
+	// instead of the client-resolved IP, so DNS is resolved near the exit.
+	// Connections without a usable name still go by IP.
+	ConnectByHost bool `json:"connect_by_host,omitempty"`
+
+	// PrewarmConns is how many ready upstream sockets pgw-fwd keeps for the
+	// mapping; 0 uses PGW_FWD_PREWARM, -1 turns pre-warming off.
+	PrewarmConns int `json:"prewarm_conns,omitempty"`
+}
+
+// Rotation decides when a mapping moves on to the next proxy of its pool.
+type Rotation struct {
+	Mode         string `json:"mode"` // "interval" | "connections" | "manual"
+	EveryMinutes int    `json:"every_minutes,omitempty"`
+	EveryConns   int    `json:"every_conns,omitempty"`
+}
+
+// ExitRecord notes that from At on, a mapping's traffic left via ProxyID with ExitIP.
+type ExitRecord struct {
+	ProxyID string    `json:"proxy_id"`
+	ExitIP  string    `json:"exit_ip,omitempty"`
+	At      time.Time `json:"at"`
 }
 
 type MappingView struct {
-	ID                string `json:"id"`
-	Client            Client `json:"client"`
-	Proxy             Proxy  `json:"proxy"`
-	State             string `json:"state"`
-	LocalRedirectPort int    `json:"local_redirect_port"`
+	ID                string  `json:"id"`
+	Client            Client  `json:"client"`
+	Proxy             Proxy   `json:"proxy"`
+	Backups           []Proxy `json:"backups,omitempty"`
+	State             string  `json:"state"`
+	LocalRedirectPort int     `json:"local_redirect_port"`
+
+	Rotation      *Rotation  `json:"rotation,omitempty"`
+	ActiveProxyID string     `json:"active_proxy_id,omitempty"`
+	RotatedAt     *time.Time `json:"rotated_at,omitempty"`
+	ExitIP        string     `json:"exit_ip,omitempty"`
+	PrevExitIP    string     `json:"prev_exit_ip,omitempty"`
+	StickyTTLSec  int        `json:"sticky_ttl_sec,omitempty"`
+
+	Quota     *QuotaState `json:"quota,omitempty"`
+	RateLimit *RateLimit  `json:"rate_limit,omitempty"` // mapping override; see Client.RateLimit
+
+	IdleTimeoutSec int  `json:"idle_timeout_sec,omitempty"`
+	ConnectByHost  bool `json:"connect_by_host,omitempty"`
+	PrewarmConns   int  `json:"prewarm_conns,omitempty"`
+}
+
+// Pool returns the mapping's upstreams in failover order: Proxy, then Backups.
+func (mv MappingView) Pool() []Proxy {
+	return append([]Proxy{mv.Proxy}, mv.Backups...)
+}
+
+// FwdRoutes is what pgw-fwd builds its routes from (GET /v1/fwd/routes).
+type FwdRoutes struct {
+	Mappings []MappingView  `json:"mappings"`
+	Proxies  []Proxy        `json:"proxies"`
+	Policies []DomainPolicy `json:"policies"`
 }
@@ -0,0 +1,37 @@
+#!/bin/bash
+# Wait until every draining pgw-fwd process has finished its connections.
+# Use after `systemctl reload pgw-fwd` (listener handoff) or before a host
+# reboot once the forwarders have been stopped.
+#
+#   scripts/fwd-drain-wait.sh [timeout_seconds]   (default 60)
+
+STATUS_DIR="${PGW_FWD_STATUS_DIR:-/run/pgw}"
+TIMEOUT="${1:-60}"
+
+deadline=$(( $(date +%s) + TIMEOUT ))
+while :; do
+    draining=0
+    total=0
+    for f in "$STATUS_DIR"/fwd-*.json; do
+        [[ -e "$f" ]] || continue
+        grep -q '"state":"draining"' "$f" || continue
+        pid=$(grep -o '"pid":[0-9]*' "$f" | cut -d: -f2)
+        if ! kill -0 "$pid" 2>/dev/null; then
+            continue # exited without cleaning up
+        fi
+        n=$(grep -o '"active":[0-9]*' "$f" | cut -d: -f2)
+        draining=$(( draining + 1 ))
+        total=$(( total + n ))
+    done
+
+    if [[ $draining -eq 0 ]]; then
+        echo "[$(date '+%H:%M:%S')] no pgw-fwd draining"
+        exit 0
+    fi
+    if [[ $(date +%s) -ge $deadline ]]; then
+        echo "[$(date '+%H:%M:%S')] timeout: $draining process(es) still draining, $total connections" >&2
+        exit 1
+    fi
+    echo "[$(date '+%H:%M:%S')] $draining process(es) draining, $total active connections"
+    sleep 1
+done